@@ -0,0 +1,72 @@
+package flow
+
+import (
+	"time"
+
+	"github.com/golang/geo/r3"
+	"gonum.org/v1/gonum/mat"
+)
+
+type velocitySample struct {
+	t time.Time
+	v r3.Vector
+}
+
+// velocityHistory keeps the last few velocities to differentiate into acceleration.
+// It fits a polynomial to them by least squares and takes its slope at the newest one, which is a
+// Savitzky-Golay filter that doesn't need the frames to be evenly spaced.
+type velocityHistory struct {
+	samples []velocitySample
+	size    int // how many velocities to fit
+	order   int // of the polynomial, 1 is a line
+}
+
+// add records a velocity, starting over if it has been more than maxGap since the last one
+func (h *velocityHistory) add(t time.Time, v r3.Vector, maxGap time.Duration) {
+	if len(h.samples) > 0 && t.Sub(h.samples[len(h.samples)-1].t) > maxGap {
+		h.samples = nil
+	}
+	h.samples = append(h.samples, velocitySample{t, v})
+	if len(h.samples) > h.size {
+		h.samples = h.samples[len(h.samples)-h.size:]
+	}
+}
+
+// acceleration returns the slope of the fit at the newest velocity, false if there aren't enough to fit
+func (h *velocityHistory) acceleration() (r3.Vector, bool) {
+	n := len(h.samples)
+	if n <= h.order {
+		return r3.Vector{}, false
+	}
+
+	// time is relative to the newest velocity, so the slope there is the linear coefficient
+	last := h.samples[n-1].t
+	a := mat.NewDense(n, h.order+1, nil)
+	x := mat.NewVecDense(n, nil)
+	y := mat.NewVecDense(n, nil)
+	z := mat.NewVecDense(n, nil)
+	for i, s := range h.samples {
+		dt := s.t.Sub(last).Seconds()
+		p := 1.0
+		for j := 0; j <= h.order; j++ {
+			a.Set(i, j, p)
+			p *= dt
+		}
+		x.SetVec(i, s.v.X)
+		y.SetVec(i, s.v.Y)
+		z.SetVec(i, s.v.Z)
+	}
+
+	var res r3.Vector
+	for _, c := range []struct {
+		b   *mat.VecDense
+		dst *float64
+	}{{x, &res.X}, {y, &res.Y}, {z, &res.Z}} {
+		var coef mat.VecDense
+		if err := coef.SolveVec(a, c.b); err != nil {
+			return r3.Vector{}, false
+		}
+		*c.dst = coef.AtVec(1)
+	}
+	return res, true
+}
@@ -0,0 +1,71 @@
+package flow
+
+import (
+	"math"
+)
+
+const (
+	// flowMinPixelError is how well a feature can be tracked at best, even when all of them agree perfectly
+	flowMinPixelError = 0.1
+	// flowTrackErrorScale is the Lucas-Kanade error, in gray levels, at which a feature's pixel error counts double
+	flowTrackErrorScale = 20.0
+)
+
+// flowVariance is how uncertain a flowResult is, assuming errors are independent and the same on each axis
+type flowVariance struct {
+	linear  float64 // (units per second)^2
+	angular float64 // (radians per second)^2
+}
+
+// unknownVariance is for before there is anything to go on
+var unknownVariance = flowVariance{linear: math.Inf(1), angular: math.Inf(1)}
+
+// known is false if there wasn't enough to estimate the variance from
+func (v flowVariance) known() bool {
+	return !math.IsInf(v.linear, 0) && !math.IsInf(v.angular, 0)
+}
+
+// variance estimates the uncertainty of the velocities from how well the inliers fit and were tracked.
+// Each feature is off by about the residual, the estimate averages that down over the inliers,
+// and the shorter the time between frames the more a pixel of error is in velocity.
+func (r flowResult) variance(dt float64) flowVariance {
+	if r.inliers == 0 || dt <= 0 {
+		return unknownVariance
+	}
+	px := math.Max(r.residual, flowMinPixelError) * (1 + r.trackError/flowTrackErrorScale)
+	px /= math.Sqrt(float64(r.inliers)) * dt
+	return flowVariance{
+		linear:  math.Pow(px*r.linearPerPixel, 2),
+		angular: math.Pow(px*r.angularPerPixel, 2),
+	}
+}
+
+// diagonal returns a row major 3x3 covariance matrix with v on the diagonal,
+// as []interface{} since readings can't hold a []float64
+func diagonal(v float64) []interface{} {
+	return []interface{}{v, 0.0, 0.0, 0.0, v, 0.0, 0.0, 0.0, v}
+}
+
+// rms returns the root mean square of values, 0 if there are none
+func rms(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+// mean returns the average of values, 0 if there are none
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,103 @@
+package flow
+
+import (
+	"image"
+	"math"
+
+	"github.com/golang/geo/r2"
+)
+
+const (
+	contactGridSize  = 3   // regions across and down time to contact is found for
+	contactMinPixels = 0.5 // features moving less than this don't say which way the scene is coming from
+)
+
+// expansion is where the scene is coming from and how soon it gets to the camera, moving forward
+type expansion struct {
+	focus r2.Point // the pixel the features move away from
+
+	// seconds until the camera reaches the scene in each region of a contactGridSize by contactGridSize
+	// grid, row major, 0 where nothing is getting closer
+	timeToContact []float64
+}
+
+// newExpansion finds the expansion of vectors over dt seconds in a frame of bounds,
+// nil if there isn't one, like when moving sideways
+func newExpansion(vectors []flowVector, dt float64, bounds image.Rectangle) *expansion {
+	focus, ok := focusOfExpansion(vectors)
+	if !ok {
+		return nil
+	}
+	return &expansion{
+		focus:         focus,
+		timeToContact: timeToContact(vectors, focus, dt, bounds, contactGridSize),
+	}
+}
+
+// focusOfExpansion returns the point the inliers of vectors move straight away from or toward, where the lines
+// along them cross in the least squares sense, false if they are too close to parallel to tell
+func focusOfExpansion(vectors []flowVector) (r2.Point, bool) {
+	var a11, a12, a22, b1, b2 float64
+	lines := 0
+	for _, v := range vectors {
+		d := v.to.Sub(v.from)
+		if !v.inlier || d.Norm() < contactMinPixels {
+			continue
+		}
+		// the point has to be on the line, so not off it along its normal
+		n := d.Ortho().Normalize()
+		c := n.Dot(v.from)
+		a11 += n.X * n.X
+		a12 += n.X * n.Y
+		a22 += n.Y * n.Y
+		b1 += n.X * c
+		b2 += n.Y * c
+		lines++
+	}
+	if lines < 2 {
+		return r2.Point{}, false
+	}
+
+	// the smallest eigenvalue is how spread out the directions are, 0 when they are all parallel
+	half := (a11 + a22) / 2
+	det := a11*a22 - a12*a12
+	if half-math.Sqrt(max(half*half-det, 0)) < 0.05*float64(lines) {
+		return r2.Point{}, false
+	}
+	return r2.Point{X: (a22*b1 - a12*b2) / det, Y: (a11*b2 - a12*b1) / det}, true
+}
+
+// timeToContact returns, for each region of a size by size grid over bounds, the median over the features in it
+// of how far they are from focus over how fast they move away from it, which is the seconds until the camera
+// reaches them if it keeps going, 0 where nothing is getting closer. Only inliers move with the camera,
+// the rest are something moving on its own, like the features focus was found from.
+func timeToContact(vectors []flowVector, focus r2.Point, dt float64, bounds image.Rectangle, size int) []float64 {
+	cells := gridCells(bounds, size)
+	times := make([][]float64, len(cells))
+	for _, v := range vectors {
+		if !v.inlier {
+			continue
+		}
+		r := v.from.Sub(focus)
+		if r.Norm() < 1 {
+			continue
+		}
+		rate := v.to.Sub(v.from).Dot(r.Normalize()) / dt
+		if rate <= 0 {
+			continue
+		}
+		pt := image.Pt(int(v.from.X), int(v.from.Y))
+		for i, cell := range cells {
+			if pt.In(cell) {
+				times[i] = append(times[i], r.Norm()/rate)
+				break
+			}
+		}
+	}
+
+	ttc := make([]float64, len(cells))
+	for i, t := range times {
+		ttc[i] = trimmedMean(t, 0.5)
+	}
+	return ttc
+}
@@ -0,0 +1,135 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+
+	"github.com/golang/geo/r2"
+	"gocv.io/x/gocv"
+)
+
+var (
+	inlierColor  = color.RGBA{G: 255, A: 255}
+	outlierColor = color.RGBA{R: 255, A: 255}
+)
+
+// flowVector is a feature that was tracked from one frame to the next, for drawing
+type flowVector struct {
+	from, to r2.Point
+	inlier   bool
+}
+
+// denseField is the flow at each pixel of roi, x and y interleaved, for drawing
+type denseField struct {
+	roi  image.Rectangle
+	data []float32
+}
+
+// flowVectors returns the vectors for the features idx points to, inliers is over idx
+func flowVectors(prev, next []gocv.Point2f, idx []int, inliers []bool) []flowVector {
+	vectors := make([]flowVector, len(idx))
+	for j, i := range idx {
+		vectors[j] = flowVector{
+			from:   r2.Point{X: float64(prev[i].X), Y: float64(prev[i].Y)},
+			to:     r2.Point{X: float64(next[i].X), Y: float64(next[i].Y)},
+			inlier: j < len(inliers) && inliers[j],
+		}
+	}
+	return vectors
+}
+
+// drawTracks draws each vector on frame as an arrow, green for inliers and red for outliers
+func drawTracks(frame image.Image, vectors []flowVector) (image.Image, error) {
+	mat, err := imageToMat(frame)
+	if err != nil {
+		return nil, err
+	}
+	defer mat.Close()
+
+	for _, v := range vectors {
+		c := outlierColor
+		if v.inlier {
+			c = inlierColor
+		}
+		to := image.Pt(int(math.Round(v.to.X)), int(math.Round(v.to.Y)))
+		gocv.ArrowedLine(&mat, image.Pt(int(math.Round(v.from.X)), int(math.Round(v.from.Y))), to, c, 1)
+		gocv.Circle(&mat, to, 2, c, -1)
+	}
+	return mat.ToImage()
+}
+
+// drawDense draws the flow in field as hue for direction and brightness for speed, black outside its roi
+func drawDense(bounds image.Rectangle, field denseField) image.Image {
+	img := image.NewRGBA(bounds)
+	for i := range img.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+
+	biggest := 0.0
+	for i := 0; i+1 < len(field.data); i += 2 {
+		biggest = math.Max(biggest, math.Hypot(float64(field.data[i]), float64(field.data[i+1])))
+	}
+	if biggest == 0 {
+		return img
+	}
+
+	for y := 0; y < field.roi.Dy(); y++ {
+		for x := 0; x < field.roi.Dx(); x++ {
+			i := 2 * (y*field.roi.Dx() + x)
+			dx, dy := float64(field.data[i]), float64(field.data[i+1])
+			hue := math.Mod(math.Atan2(dy, dx)*180/math.Pi+360, 360)
+			img.Set(field.roi.Min.X+x, field.roi.Min.Y+y, hsv(hue, 1, math.Hypot(dx, dy)/biggest))
+		}
+	}
+	return img
+}
+
+// hsv converts hue in degrees, saturation and value between 0 and 1 to a color
+func hsv(h, s, v float64) color.RGBA {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 255,
+	}
+}
+
+// encodeDebugImage returns img as a jpeg in a DoCommand response
+func encodeDebugImage(img image.Image) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return nil, fmt.Errorf("cannot encode debug image: %w", err)
+	}
+	return map[string]interface{}{
+		"image":     base64.StdEncoding.EncodeToString(buf.Bytes()),
+		"mime_type": "image/jpeg",
+		"width":     img.Bounds().Dx(),
+		"height":    img.Bounds().Dy(),
+	}, nil
+}
@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/geo/r2"
+	"github.com/golang/geo/r3"
+	"gocv.io/x/gocv"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/spatialmath"
+)
+
+// denseParams are the settings for dense flow
+type denseParams struct {
+	roi  *image.Rectangle // only use the flow inside this, nil is the whole frame
+	step int              // use every step-th pixel in each direction
+	trim float64          // fraction cut off each end before averaging, 0.5 is the median
+}
+
+// trimmedMean averages values after cutting trim of them off each end, sorting them.
+// At a trim of 0.5 or more it is the median.
+func trimmedMean(values []float64, trim float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if trim >= 0.5 {
+		if n%2 == 1 {
+			return values[n/2]
+		}
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	cut := int(trim * float64(n))
+	return mean(values[cut : n-cut])
+}
+
+// computeDenseFlow is computeFlow using Farneback dense optical flow instead of tracking corners, which
+// works on surfaces without any, like carpet or concrete. The motion is a robust average over the roi.
+func computeDenseFlow(prev, now image.Image, timeBetween time.Duration, focalLengthPx float64,
+	derotate func(r2.Point) r2.Point, params denseParams, logger logging.Logger) (flowResult, error) {
+	dt := timeBetween.Seconds()
+	if dt <= 0 {
+		return flowResult{}, errors.New("time between frames must be positive")
+	}
+
+	prevGray, err := toGray(prev)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer prevGray.Close()
+
+	nowGray, err := toGray(now)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer nowGray.Close()
+
+	frame := image.Rect(0, 0, prevGray.Cols(), prevGray.Rows())
+	roi := frame
+	if params.roi != nil {
+		roi = params.roi.Intersect(frame)
+	}
+	if roi.Empty() {
+		return flowResult{}, fmt.Errorf("dense roi %v is outside of the %v frame", params.roi, frame)
+	}
+
+	prevRegion := prevGray.Region(roi)
+	defer prevRegion.Close()
+	nowRegion := nowGray.Region(roi)
+	defer nowRegion.Close()
+
+	dense := gocv.NewMat()
+	defer dense.Close()
+	gocv.CalcOpticalFlowFarneback(prevRegion, nowRegion, &dense, 0.5, 3, 15, 3, 5, 1.2, 0)
+
+	data, err := dense.DataPtrFloat32()
+	if err != nil {
+		return flowResult{}, err
+	}
+
+	field := &denseField{roi: roi, data: append([]float32{}, data...)}
+
+	center := r2.Point{X: float64(frame.Dx()) / 2, Y: float64(frame.Dy()) / 2}
+	step := max(params.step, 1)
+
+	dxs, dys, angles := []float64{}, []float64{}, []float64{}
+	for y := 0; y < roi.Dy(); y += step {
+		for x := 0; x < roi.Dx(); x += step {
+			i := 2 * (y*roi.Dx() + x)
+			p := r2.Point{X: float64(roi.Min.X + x), Y: float64(roi.Min.Y + y)}
+			next := p.Add(r2.Point{X: float64(data[i]), Y: float64(data[i+1])})
+			if derotate != nil {
+				next = derotate(next)
+			}
+
+			d := next.Sub(p)
+			dxs = append(dxs, d.X)
+			dys = append(dys, d.Y)
+			angles = append(angles, normalizeAngle(math.Atan2(next.Y-center.Y, next.X-center.X)-
+				math.Atan2(p.Y-center.Y, p.X-center.X)))
+		}
+	}
+
+	// trimmedMean sorts each of dxs and dys, so pair them up first
+	moved := make([]r2.Point, len(dxs))
+	for i := range dxs {
+		moved[i] = r2.Point{X: dxs[i], Y: dys[i]}
+	}
+	avg := r2.Point{X: trimmedMean(dxs, params.trim), Y: trimmedMean(dys, params.trim)}
+	angle := trimmedMean(angles, params.trim)
+
+	// samples near the average agree on the motion, the rest are something else moving or no texture
+	spread := []float64{}
+	for _, m := range moved {
+		if d := m.Sub(avg).Norm(); d <= flowInlierPixels {
+			spread = append(spread, d)
+		}
+	}
+
+	logger.Debugf("dense flow %v over %v, %d of %d samples agree", avg, roi, len(spread), len(moved))
+
+	return flowResult{
+		linear:          r3.Vector{X: avg.X / dt / focalLengthPx, Y: avg.Y / dt / focalLengthPx},
+		angular:         spatialmath.AngularVelocity{Z: -angle / dt}, // the camera turns the other way
+		tracked:         len(moved),
+		inliers:         len(spread),
+		residual:        rms(spread),
+		linearPerPixel:  1 / focalLengthPx,
+		angularPerPixel: 1 / focalLengthPx,
+		pixels:          avg.Norm(),
+		dense:           field,
+	}, nil
+}
@@ -0,0 +1,327 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/geo/r2"
+	"github.com/golang/geo/r3"
+	"gonum.org/v1/gonum/mat"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/spatialmath"
+)
+
+const (
+	essentialSampleSize       = 8
+	essentialMinPoints        = 12
+	essentialRansacIterations = 200
+	essentialPixelError       = 1.0 // pixels
+
+	// below this median parallax, in pixels once rotation is removed, the translation direction is just noise
+	essentialMinParallax = .5
+)
+
+// essentialMotion is the relative pose between two calibrated views, with x_now = rot * x_prev + t
+type essentialMotion struct {
+	rvec r3.Vector // axis times angle in radians
+	t    r3.Vector // unit length, or zero if there wasn't enough parallax to tell
+
+	parallax float64 // median pixels the inliers moved apart from the rotation
+	residual float64 // RMS Sampson distance of the inliers in pixels
+}
+
+// mulVec returns m * v for a 3x3 matrix
+func mulVec(m mat.Matrix, v r3.Vector) r3.Vector {
+	return r3.Vector{
+		X: m.At(0, 0)*v.X + m.At(0, 1)*v.Y + m.At(0, 2)*v.Z,
+		Y: m.At(1, 0)*v.X + m.At(1, 1)*v.Y + m.At(1, 2)*v.Z,
+		Z: m.At(2, 0)*v.X + m.At(2, 1)*v.Y + m.At(2, 2)*v.Z,
+	}
+}
+
+// rotationVector converts a rotation matrix to axis times angle in radians
+func rotationVector(r mat.Matrix) r3.Vector {
+	axis := r3.Vector{
+		X: r.At(2, 1) - r.At(1, 2),
+		Y: r.At(0, 2) - r.At(2, 0),
+		Z: r.At(1, 0) - r.At(0, 1),
+	}
+	cos := (r.At(0, 0) + r.At(1, 1) + r.At(2, 2) - 1) / 2
+	theta := math.Acos(math.Max(-1, math.Min(1, cos)))
+	if theta < 1e-9 {
+		return axis.Mul(.5)
+	}
+	return axis.Mul(theta / (2 * math.Sin(theta)))
+}
+
+func homogeneous(p r2.Point) r3.Vector {
+	return r3.Vector{X: p.X, Y: p.Y, Z: 1}
+}
+
+// fitEssential estimates E with b^T E a = 0 for the correspondences at idx, in normalized image coordinates,
+// using the 8-point algorithm
+func fitEssential(a, b []r2.Point, idx []int) (*mat.Dense, bool) {
+	rows := mat.NewDense(max(len(idx), 9), 9, nil)
+	for r, i := range idx {
+		rows.SetRow(r, []float64{
+			b[i].X * a[i].X, b[i].X * a[i].Y, b[i].X,
+			b[i].Y * a[i].X, b[i].Y * a[i].Y, b[i].Y,
+			a[i].X, a[i].Y, 1,
+		})
+	}
+
+	var svd mat.SVD
+	if !svd.Factorize(rows, mat.SVDFull) {
+		return nil, false
+	}
+	var v mat.Dense
+	svd.VTo(&v)
+
+	e := mat.NewDense(3, 3, nil)
+	for i := 0; i < 9; i++ {
+		e.Set(i/3, i%3, v.At(i, 8))
+	}
+
+	// project onto the essential manifold, two equal singular values and one zero
+	var esvd mat.SVD
+	if !esvd.Factorize(e, mat.SVDFull) {
+		return nil, false
+	}
+	var u, ev mat.Dense
+	esvd.UTo(&u)
+	esvd.VTo(&ev)
+
+	var out mat.Dense
+	out.Product(&u, mat.NewDiagDense(3, []float64{1, 1, 0}), ev.T())
+	return &out, true
+}
+
+// sampsonDistance is the first order approximation of how far a correspondence is from satisfying E
+func sampsonDistance(e mat.Matrix, a, b r2.Point) float64 {
+	ea := mulVec(e, homogeneous(a))
+	etb := mulVec(e.T(), homogeneous(b))
+	num := homogeneous(b).Dot(ea)
+	den := ea.X*ea.X + ea.Y*ea.Y + etb.X*etb.X + etb.Y*etb.Y
+	if den == 0 {
+		return math.Inf(1)
+	}
+	return math.Abs(num) / math.Sqrt(den)
+}
+
+// triangulatedDepths returns the depth of a correspondence in both views for x_b = rot * x_a + t
+func triangulatedDepths(rot mat.Matrix, t r3.Vector, a, b r2.Point) (float64, float64) {
+	xb := homogeneous(b)
+	ra := mulVec(rot, homogeneous(a))
+	c := xb.Cross(ra)
+	den := c.Norm2()
+	if den == 0 {
+		return 0, 0
+	}
+	za := -xb.Cross(t).Dot(c) / den
+	zb := ra.Mul(za).Add(t).Z
+	return za, zb
+}
+
+// decomposeEssential picks the one of the four rotation and translation pairs in E
+// that puts the most inliers in front of both cameras
+func decomposeEssential(e mat.Matrix, a, b []r2.Point, inliers []bool) (*mat.Dense, r3.Vector) {
+	var svd mat.SVD
+	svd.Factorize(e, mat.SVDFull)
+	var u, v mat.Dense
+	svd.UTo(&u)
+	svd.VTo(&v)
+	if mat.Det(&u) < 0 {
+		u.Scale(-1, &u)
+	}
+	if mat.Det(&v) < 0 {
+		v.Scale(-1, &v)
+	}
+
+	w := mat.NewDense(3, 3, []float64{0, -1, 0, 1, 0, 0, 0, 0, 1})
+	var r1, r2 mat.Dense
+	r1.Product(&u, w, v.T())
+	r2.Product(&u, w.T(), v.T())
+	t := r3.Vector{X: u.At(0, 2), Y: u.At(1, 2), Z: u.At(2, 2)}
+
+	var bestRot *mat.Dense
+	var bestT r3.Vector
+	bestCount := -1
+	for _, rot := range []*mat.Dense{&r1, &r2} {
+		for _, tt := range []r3.Vector{t, t.Mul(-1)} {
+			count := 0
+			for i, in := range inliers {
+				if !in {
+					continue
+				}
+				za, zb := triangulatedDepths(rot, tt, a[i], b[i])
+				if za > 0 && zb > 0 {
+					count++
+				}
+			}
+			if count > bestCount {
+				bestRot, bestT, bestCount = rot, tt, count
+			}
+		}
+	}
+	return bestRot, bestT
+}
+
+// estimateEssentialMotion recovers rotation and translation direction between two views from
+// correspondences in normalized image coordinates, using RANSAC over the 8-point algorithm.
+// focal is only used to express the pixel thresholds in normalized coordinates.
+func estimateEssentialMotion(a, b []r2.Point, focal float64) (essentialMotion, []bool, error) {
+	if len(a) < essentialMinPoints {
+		return essentialMotion{}, nil, fmt.Errorf("only %d points, need %d", len(a), essentialMinPoints)
+	}
+
+	threshold := essentialPixelError / focal
+	inliers := ransac(len(a), essentialSampleSize, essentialRansacIterations, threshold,
+		func(idx []int) (*mat.Dense, bool) {
+			return fitEssential(a, b, idx)
+		},
+		func(e *mat.Dense, i int) float64 {
+			return sampsonDistance(e, a[i], b[i])
+		},
+	)
+
+	idx := []int{}
+	for i, in := range inliers {
+		if in {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < essentialMinPoints {
+		return essentialMotion{}, nil, fmt.Errorf("only %d of %d points agree on a motion", len(idx), len(a))
+	}
+
+	// refit on all inliers, then once more on the inliers of that better fit
+	var e *mat.Dense
+	for pass := 0; pass < 2; pass++ {
+		var ok bool
+		e, ok = fitEssential(a, b, idx)
+		if !ok {
+			return essentialMotion{}, nil, fmt.Errorf("cannot refine essential matrix on inliers")
+		}
+		if pass == 0 {
+			refit := []int{}
+			for i := range a {
+				inliers[i] = sampsonDistance(e, a[i], b[i]) <= threshold
+				if inliers[i] {
+					refit = append(refit, i)
+				}
+			}
+			if len(refit) < essentialMinPoints {
+				return essentialMotion{}, nil, fmt.Errorf("only %d of %d points agree on a refined motion", len(refit), len(a))
+			}
+			idx = refit
+		}
+	}
+
+	rot, t := decomposeEssential(e, a, b, inliers)
+	m := essentialMotion{rvec: rotationVector(rot), t: t}
+
+	// with only rotation, or no motion at all, any translation direction fits
+	parallax := []float64{}
+	for _, i := range idx {
+		ra := mulVec(rot, homogeneous(a[i]))
+		parallax = append(parallax, math.Hypot(ra.X/ra.Z-b[i].X, ra.Y/ra.Z-b[i].Y)*focal)
+	}
+	sort.Float64s(parallax)
+	m.parallax = parallax[len(parallax)/2]
+	if m.parallax < essentialMinParallax {
+		m.t = r3.Vector{}
+	}
+
+	distances := []float64{}
+	for _, i := range idx {
+		distances = append(distances, sampsonDistance(e, a[i], b[i])*focal)
+	}
+	m.residual = rms(distances)
+
+	return m, inliers, nil
+}
+
+// computeEgoMotion calculates the motion of a single calibrated camera between two frames.
+// Returns:
+// - the direction of travel as a unit r3.Vector in the camera frame (x right, y down, z forward), zero if it isn't moving
+// - angular velocity in radians per second in the same frame
+// - how many features were tracked, and how many of them were inliers
+// - error if there weren't enough consistent features
+func computeEgoMotion(prev, now image.Image, timeBetween time.Duration, k intrinsics, params trackerParams,
+	tracks *featureTracker, logger logging.Logger) (flowResult, error) {
+	dt := timeBetween.Seconds()
+	if dt <= 0 {
+		return flowResult{}, errors.New("time between frames must be positive")
+	}
+
+	prevGray, err := toGray(prev)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer prevGray.Close()
+
+	nowGray, err := toGray(now)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer nowGray.Close()
+
+	prevPts := tracks.features(prevGray, params)
+	nextPts, tracked, trackErrs := trackPoints(prevGray, nowGray, prevPts, params)
+
+	// only tracks that were inliers are followed into the next frame
+	keep := make([]bool, len(prevPts))
+	defer tracks.update(nextPts, keep)
+
+	a := []r2.Point{}
+	b := []r2.Point{}
+	errs := []float64{}
+	okIdx := []int{}
+	for i := range prevPts {
+		if tracked[i] {
+			okIdx = append(okIdx, i)
+			a = append(a, k.normalize(prevPts[i]))
+			b = append(b, k.normalize(nextPts[i]))
+			errs = append(errs, trackErrs[i])
+		}
+	}
+
+	logger.Debugf("ego motion features: %d detected, %d tracked", len(prevPts), len(a))
+
+	m, inliers, err := estimateEssentialMotion(a, b, k.focal)
+	if err != nil {
+		return flowResult{}, err
+	}
+
+	// m moves points into the new camera frame, the camera itself moved by the inverse of that
+	direction := rotate(m.rvec.Mul(-1), m.t).Mul(-1)
+	spin := m.rvec.Mul(-1 / dt)
+
+	inlierErrs := []float64{}
+	for i, in := range inliers {
+		keep[okIdx[i]] = in
+		if in {
+			inlierErrs = append(inlierErrs, errs[i])
+		}
+	}
+
+	vectors := flowVectors(prevPts, nextPts, okIdx, inliers)
+	return flowResult{
+		linear:     direction,
+		angular:    spatialmath.AngularVelocity{X: spin.X, Y: spin.Y, Z: spin.Z},
+		tracked:    len(a),
+		inliers:    countTrue(inliers),
+		residual:   m.residual,
+		trackError: mean(inlierErrs),
+		vectors:    vectors,
+		pixels:     medianMotion(vectors),
+		// the direction turns by about a pixel over how far the features moved apart
+		linearPerPixel:  1 / math.Max(m.parallax, essentialMinParallax),
+		angularPerPixel: 1 / k.focal,
+	}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/golang/geo/r2"
 	"github.com/golang/geo/r3"
 	"gocv.io/x/gocv"
 
@@ -13,122 +14,265 @@ import (
 	"go.viam.com/rdk/spatialmath"
 )
 
+// flowResult is what was found between two frames
+type flowResult struct {
+	linear  r3.Vector
+	angular spatialmath.AngularVelocity
+
+	tracked int // features followed into the new frame
+	inliers int // tracked features that agree on the motion
+
+	// for accuracy, see variance
+	residual        float64 // RMS pixels the inliers are off from the motion
+	trackError      float64 // mean Lucas-Kanade error of the inliers
+	linearPerPixel  float64 // linear motion a pixel of every feature moving amounts to
+	angularPerPixel float64 // radians a pixel of every feature moving amounts to
+
+	trackAge float64 // frames the features still being followed have been on average
+	pixels   float64 // median pixels the inliers moved, for picking keyframes
+
+	// where the scene is coming from and how soon it gets here, nil if not known
+	expansion *expansion
+
+	// for debug_image
+	vectors []flowVector
+	dense   *denseField
+}
+
+// inlierRatio is the fraction of tracked features that agree on the motion
+func (r flowResult) inlierRatio() float64 {
+	if r.tracked == 0 {
+		return 0
+	}
+	return float64(r.inliers) / float64(r.tracked)
+}
+
+const (
+	flowRansacIterations = 100
+	flowInlierPixels     = 3.0
+)
+
+// similarityMotion is a rotation and scaling about the image center followed by a translation, in pixels.
+// The scale lets features at similar depths agree while moving forward or backward.
+type similarityMotion struct {
+	theta float64
+	scale float64
+	t     r2.Point
+}
+
+func (m similarityMotion) apply(p, center r2.Point) r2.Point {
+	d := p.Sub(center).Mul(m.scale)
+	sin, cos := math.Sincos(m.theta)
+	return r2.Point{X: d.X*cos - d.Y*sin, Y: d.X*sin + d.Y*cos}.Add(center).Add(m.t)
+}
+
+// fitSimilarityMotion finds the motion taking prev[i] to next[i] and prev[j] to next[j]
+func fitSimilarityMotion(prev, next []r2.Point, i, j int, center r2.Point) (similarityMotion, bool) {
+	dp := prev[j].Sub(prev[i])
+	dn := next[j].Sub(next[i])
+	if dp.Norm() < 1 || dn.Norm() < 1 {
+		return similarityMotion{}, false
+	}
+	m := similarityMotion{
+		theta: math.Atan2(dn.Y, dn.X) - math.Atan2(dp.Y, dp.X),
+		scale: dn.Norm() / dp.Norm(),
+	}
+	m.t = next[i].Sub(m.apply(prev[i], center))
+	return m, true
+}
+
+// similarityScale returns how much the inliers spread apart from prev to next, from the least squares
+// similarity between them about their centroids, 1 if there aren't enough of them spread out enough to tell
+func similarityScale(prev, next []r2.Point, inliers []bool) float64 {
+	var mp, mn r2.Point
+	n := 0
+	for i := range prev {
+		if inliers[i] {
+			mp, mn = mp.Add(prev[i]), mn.Add(next[i])
+			n++
+		}
+	}
+	if n < 2 {
+		return 1
+	}
+	mp, mn = mp.Mul(1/float64(n)), mn.Mul(1/float64(n))
+
+	var a, b, spread float64
+	for i := range prev {
+		if inliers[i] {
+			p, q := prev[i].Sub(mp), next[i].Sub(mn)
+			a += p.Dot(q)
+			b += p.Cross(q)
+			spread += p.Dot(p)
+		}
+	}
+	if spread < 1 {
+		return 1
+	}
+	return math.Hypot(a, b) / spread
+}
+
 // computeFlow calculates linear and angular velocity from two consecutive images
 // prev: previous image frame
 // now: current image frame
 // timeBetween: time duration between the two frames
+// derotate: if not nil, moves a tracked point in the current frame to undo the camera's rotation
+// params: how to find and track features
+// tracks: features followed from earlier frames, nil to find new ones every time
+// The motion of the tracked features is fit with RANSAC, and only the inliers are averaged,
+// so something moving through the view or a bad track doesn't skew the result.
+// Features spreading apart means the camera is moving forward, which is positive z.
 // Returns:
-// - linear velocity as r3.Vector (x,y,z components in units/second)
-// - angular velocity using Viam's spatialmath.AngularVelocity
+// - linear velocity as r3.Vector (x,y,z components in units/second), x and y the way the features move, z forward
+// - angular velocity of the camera about its optical axis, using Viam's spatialmath.AngularVelocity
+// - how many features were tracked, and how many of them were inliers
 // - error if processing fails
-func computeFlow(prev, now image.Image, timeBetween time.Duration, focalLengthPx float64, logger logging.Logger) (r3.Vector, spatialmath.AngularVelocity, error) {
+func computeFlow(prev, now image.Image, timeBetween time.Duration, focalLengthPx float64,
+	derotate func(r2.Point) r2.Point, params trackerParams, tracks *featureTracker, logger logging.Logger) (flowResult, error) {
 	// Convert time to seconds
 	dt := timeBetween.Seconds()
 	if dt <= 0 {
-		return r3.Vector{}, spatialmath.AngularVelocity{}, errors.New("time between frames must be positive")
+		return flowResult{}, errors.New("time between frames must be positive")
 	}
 
-	// Convert image.Image to gocv.Mat
-	prevMat, err := imageToMat(prev)
+	// Convert to grayscale for optical flow
+	prevGray, err := toGray(prev)
 	if err != nil {
-		return r3.Vector{}, spatialmath.AngularVelocity{}, err
+		return flowResult{}, err
 	}
-	defer prevMat.Close()
+	defer prevGray.Close()
 
-	nowMat, err := imageToMat(now)
+	nowGray, err := toGray(now)
 	if err != nil {
-		return r3.Vector{}, spatialmath.AngularVelocity{}, err
+		return flowResult{}, err
 	}
-	defer nowMat.Close()
-
-	// Convert to grayscale for optical flow
-
-	prevGray := gocv.NewMat()
-	defer prevGray.Close()
-	gocv.CvtColor(prevMat, &prevGray, gocv.ColorBGRToGray)
-
-	nowGray := gocv.NewMat()
 	defer nowGray.Close()
-	gocv.CvtColor(nowMat, &nowGray, gocv.ColorBGRToGray)
-
-	// Find features to track in previous image usingn Shi-Tomasi corner detector
 
-	prevPts := gocv.NewMat()
-	defer prevPts.Close()
-	gocv.GoodFeaturesToTrack(prevGray, &prevPts, 100, 0.3, 10)
+	// Find features to track in previous image
+	prevPts := tracks.features(prevGray, params)
 
 	// If no features found, return zero velocity
-	if prevPts.Rows() == 0 {
-		return r3.Vector{}, spatialmath.AngularVelocity{}, nil
+	if len(prevPts) == 0 {
+		return flowResult{}, nil
 	}
 
 	// Calculate optical flow using Lucas-Kanade method
-	nextPts := gocv.NewMat()
-	defer nextPts.Close()
-
-	status := gocv.NewMat()
-	defer status.Close()
-
-	errMat := gocv.NewMat()
-	defer errMat.Close()
-
-	// Apply optical flow algorithm
-	gocv.CalcOpticalFlowPyrLK(prevGray, nowGray, prevPts, nextPts, &status, &errMat)
-
-	// now we do our math in vectors
-
-	nextPtsVec := gocv.NewPointVectorFromMat(nextPts)
-	defer nextPtsVec.Close()
+	nextPts, tracked, trackErrs := trackPoints(prevGray, nowGray, prevPts, params)
+
+	logger.Debugf("prev/next pts %d %d", len(prevPts), len(nextPts))
+
+	// only tracks that were inliers are followed into the next frame
+	keep := make([]bool, len(prevPts))
+	defer tracks.update(nextPts, keep)
+
+	// Keep the successfully tracked points
+	prevOk := []r2.Point{}
+	nextOk := []r2.Point{}
+	errOk := []float64{}
+	okIdx := []int{}
+	for i := range prevPts {
+		if tracked[i] {
+			okIdx = append(okIdx, i)
+			errOk = append(errOk, trackErrs[i])
+			prevOk = append(prevOk, r2.Point{X: float64(prevPts[i].X), Y: float64(prevPts[i].Y)})
+			next := r2.Point{X: float64(nextPts[i].X), Y: float64(nextPts[i].Y)}
+			if derotate != nil {
+				next = derotate(next)
+			}
+			nextOk = append(nextOk, next)
+		}
+	}
 
-	prevPtsVec := gocv.NewPointVectorFromMat(prevPts)
-	defer prevPtsVec.Close()
+	if len(prevOk) == 0 {
+		return flowResult{}, nil
+	}
 
-	logger.Debugf("prev/next pt vectors %d %d", prevPtsVec.Size(), nextPtsVec.Size())
+	// Get image center for angular calculations
+	center := r2.Point{X: float64(prevGray.Cols()) / 2, Y: float64(prevGray.Rows()) / 2}
+
+	// Find the points that agree on one motion, with too few for RANSAC all of them count
+	inliers := ransac(len(prevOk), 2, flowRansacIterations, flowInlierPixels,
+		func(idx []int) (similarityMotion, bool) {
+			return fitSimilarityMotion(prevOk, nextOk, idx[0], idx[1], center)
+		},
+		func(m similarityMotion, i int) float64 {
+			return m.apply(prevOk[i], center).Sub(nextOk[i]).Norm()
+		},
+	)
+	if inliers == nil {
+		inliers = make([]bool, len(prevOk))
+		for i := range inliers {
+			inliers[i] = true
+		}
+	}
+	for j, i := range okIdx {
+		keep[i] = inliers[j]
+	}
+	vectors := flowVectors(prevPts, nextPts, okIdx, inliers)
 
 	// Process optical flow results
 	var sumDx, sumDy float64
 	var sumAngularZ float64
 	validPoints := 0
+	moved := []r2.Point{}
+	inlierErrs := []float64{}
 
-	// Get image center for angular calculations
-	centerX := float64(prevGray.Cols()) / 2
-	centerY := float64(prevGray.Rows()) / 2
-
-	for i := 0; i < prevPtsVec.Size(); i++ {
-		// Check if point was successfully tracked
-		if status.GetUCharAt(i, 0) == 1 {
-			prevPt := prevPtsVec.At(i)
-			nextPt := nextPtsVec.At(i)
-
-			// Calculate displacement
-			dx := float64(nextPt.X - prevPt.X)
-			dy := float64(nextPt.Y - prevPt.Y)
-
-			// Calculate angular displacement around z-axis using points relative to center
-			prevAngle := math.Atan2(float64(prevPt.Y)-centerY, float64(prevPt.X)-centerX)
-			nextAngle := math.Atan2(float64(nextPt.Y)-centerY, float64(nextPt.X)-centerX)
-			angularDisplacement := normalizeAngle(nextAngle - prevAngle)
-
-			sumDx += dx
-			sumDy += dy
-			sumAngularZ += angularDisplacement
-			validPoints++
+	for i := range prevOk {
+		if !inliers[i] {
+			continue
 		}
+		prevPt := prevOk[i]
+		nextPt := nextOk[i]
+
+		// Calculate displacement
+		dx := nextPt.X - prevPt.X
+		dy := nextPt.Y - prevPt.Y
+
+		// Calculate angular displacement around z-axis using points relative to center
+		prevAngle := math.Atan2(prevPt.Y-center.Y, prevPt.X-center.X)
+		nextAngle := math.Atan2(nextPt.Y-center.Y, nextPt.X-center.X)
+		angularDisplacement := normalizeAngle(nextAngle - prevAngle)
+
+		sumDx += dx
+		sumDy += dy
+		sumAngularZ += angularDisplacement
+		validPoints++
+		moved = append(moved, r2.Point{X: dx, Y: dy})
+		inlierErrs = append(inlierErrs, errOk[i])
 	}
 
+	res := flowResult{
+		tracked:         len(prevOk),
+		inliers:         validPoints,
+		trackError:      mean(inlierErrs),
+		linearPerPixel:  1 / focalLengthPx,
+		angularPerPixel: 1 / focalLengthPx,
+		pixels:          medianMotion(vectors),
+		vectors:         vectors,
+	}
 	if validPoints == 0 {
-		return r3.Vector{}, spatialmath.AngularVelocity{}, nil
+		return res, nil
 	}
 
+	logger.Debugf("flow inliers %d of %d", validPoints, len(prevOk))
+
 	// Average displacements
 	avgDx := sumDx / float64(validPoints)
 	avgDy := sumDy / float64(validPoints)
 	avgAngularZ := sumAngularZ / float64(validPoints)
 
+	// the features are averaged, so how far they are from that average is their error
+	spread := make([]float64, len(moved))
+	for i, m := range moved {
+		spread[i] = m.Sub(r2.Point{X: avgDx, Y: avgDy}).Norm()
+	}
+	res.residual = rms(spread)
+
 	// Calculate velocities
 	linearVelX := avgDx / dt
 	linearVelY := avgDy / dt
-	angularVelZ := avgAngularZ / dt
+	// the features turn the opposite way from the camera
+	angularVelZ := -avgAngularZ / dt
 
 	// Convert from pixel space to physical space (approximation)
 	// In real usage, this would depend on proper camera calibration
@@ -136,7 +280,158 @@ func computeFlow(prev, now image.Image, timeBetween time.Duration, focalLengthPx
 	linearVelX = linearVelX / focalLengthPx
 	linearVelY = linearVelY / focalLengthPx
 
-	return r3.Vector{X: linearVelX, Y: linearVelY}, spatialmath.AngularVelocity{Z: angularVelZ}, nil
+	// things look bigger by how much closer they got, so how far the camera went over the distance is 1 - 1/scale
+	linearVelZ := (1 - 1/similarityScale(prevOk, nextOk, inliers)) / dt
+
+	res.linear = r3.Vector{X: linearVelX, Y: linearVelY, Z: linearVelZ}
+
+	// with the rotation taken out, so it doesn't move the focus
+	derotated := make([]flowVector, len(prevOk))
+	for i := range prevOk {
+		derotated[i] = flowVector{from: prevOk[i], to: nextOk[i], inlier: inliers[i]}
+	}
+	res.expansion = newExpansion(derotated, dt, image.Rect(0, 0, prevGray.Cols(), prevGray.Rows()))
+	res.angular = spatialmath.AngularVelocity{Z: angularVelZ}
+	return res, nil
+}
+
+// toGray converts an image to a grayscale Mat for tracking, the caller has to Close it
+func toGray(img image.Image) (gocv.Mat, error) {
+	mat, err := imageToMat(img)
+	if err != nil {
+		return gocv.Mat{}, err
+	}
+	defer mat.Close()
+
+	gray := gocv.NewMat()
+	gocv.CvtColor(mat, &gray, gocv.ColorBGRToGray)
+	return gray, nil
+}
+
+// trackerParams are the settings for finding features and following them between frames
+type trackerParams struct {
+	maxCorners   int     // most features to find
+	qualityLevel float64 // weakest corner kept, as a fraction of the strongest
+	minDistance  float64 // pixels between features
+
+	windowSize    int     // pixels on a side of the window Lucas-Kanade matches at each pyramid level
+	pyramidLevels int     // 0 is the full size image only
+	maxIterations int     // per feature and level
+	epsilon       float64 // stop iterating when a feature moves less than this many pixels
+
+	minTracks       int     // find new features when fewer than this many are still being followed
+	gridSize        int     // new features are spread over this many cells on a side
+	forwardBackward float64 // pixels a feature tracked back to the last frame can miss where it started by
+}
+
+var defaultTrackerParams = trackerParams{
+	maxCorners:    100,
+	qualityLevel:  0.3,
+	minDistance:   10,
+	windowSize:    21,
+	pyramidLevels: 3,
+	maxIterations: 30,
+	epsilon:       0.01,
+
+	minTracks:       50,
+	gridSize:        4,
+	forwardBackward: 1,
+}
+
+// detectFeatures finds corners worth tracking using the Shi-Tomasi corner detector
+func detectFeatures(gray gocv.Mat, p trackerParams) []gocv.Point2f {
+	pts := gocv.NewMat()
+	defer pts.Close()
+	gocv.GoodFeaturesToTrack(gray, &pts, p.maxCorners, p.qualityLevel, p.minDistance)
+	if pts.Rows() == 0 {
+		return nil
+	}
+
+	v := gocv.NewPoint2fVectorFromMat(pts)
+	defer v.Close()
+	return v.ToPoints()
+}
+
+// trackPoints follows pts from prev into next using pyramidal Lucas-Kanade,
+// returning where they went, which were found, and the Lucas-Kanade error of each.
+// A feature only counts as found if tracking it back from next lands where it started.
+func trackPoints(prev, next gocv.Mat, pts []gocv.Point2f, p trackerParams) ([]gocv.Point2f, []bool, []float64) {
+	out, ok, errs := lucasKanade(prev, next, pts, p)
+	if len(out) == 0 {
+		return out, ok, errs
+	}
+
+	back, backOk, _ := lucasKanade(next, prev, out, p)
+	for i := range ok {
+		dx, dy := float64(back[i].X-pts[i].X), float64(back[i].Y-pts[i].Y)
+		ok[i] = ok[i] && backOk[i] && math.Hypot(dx, dy) <= p.forwardBackward
+	}
+	return out, ok, errs
+}
+
+// lucasKanade follows pts from prev into next one way, see trackPoints
+func lucasKanade(prev, next gocv.Mat, pts []gocv.Point2f, p trackerParams) ([]gocv.Point2f, []bool, []float64) {
+	if len(pts) == 0 {
+		return nil, nil, nil
+	}
+
+	prevVec := gocv.NewPoint2fVectorFromPoints(pts)
+	defer prevVec.Close()
+	prevPts := gocv.NewMatFromPoint2fVector(prevVec, true)
+	defer prevPts.Close()
+
+	nextPts := gocv.NewMat()
+	defer nextPts.Close()
+
+	status := gocv.NewMat()
+	defer status.Close()
+
+	errMat := gocv.NewMat()
+	defer errMat.Close()
+
+	criteria := gocv.NewTermCriteria(gocv.Count|gocv.EPS, p.maxIterations, p.epsilon)
+	gocv.CalcOpticalFlowPyrLKWithParams(prev, next, prevPts, nextPts, &status, &errMat,
+		image.Pt(p.windowSize, p.windowSize), p.pyramidLevels, criteria, 0, 1e-4)
+
+	nextVec := gocv.NewPoint2fVectorFromMat(nextPts)
+	defer nextVec.Close()
+	out := nextVec.ToPoints()
+	if len(out) < len(pts) {
+		out = append(out, make([]gocv.Point2f, len(pts)-len(out))...)
+	}
+
+	ok := make([]bool, len(pts))
+	errs := make([]float64, len(pts))
+	for i := range ok {
+		ok[i] = i < status.Rows() && status.GetUCharAt(i, 0) == 1
+		if ok[i] {
+			errs[i] = float64(errMat.GetFloatAt(i, 0))
+		}
+	}
+	return out, ok, errs
+}
+
+// rotate applies a rotation, given as axis times angle in radians, to v using Rodrigues' formula
+func rotate(rvec, v r3.Vector) r3.Vector {
+	theta := rvec.Norm()
+	if theta < 1e-12 {
+		return v
+	}
+	k := rvec.Mul(1 / theta)
+	return v.Mul(math.Cos(theta)).
+		Add(k.Cross(v).Mul(math.Sin(theta))).
+		Add(k.Mul(k.Dot(v) * (1 - math.Cos(theta))))
+}
+
+// medianMotion returns the median pixels the inliers of vectors moved
+func medianMotion(vectors []flowVector) float64 {
+	moved := []float64{}
+	for _, v := range vectors {
+		if v.inlier {
+			moved = append(moved, v.to.Sub(v.from).Norm())
+		}
+	}
+	return trimmedMean(moved, 0.5)
 }
 
 // Helper function to normalize angle to [-π, π]
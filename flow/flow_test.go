@@ -1,14 +1,30 @@
 package flow
 
 import (
+	"context"
+	"errors"
 	"image"
+	"image/color"
+	"image/draw"
 	_ "image/jpeg"
 	"math"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/geo/r2"
+	"github.com/golang/geo/r3"
+	geo "github.com/kellydunn/golang-geo"
+	"gocv.io/x/gocv"
+
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/components/movementsensor"
 	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/protoutils"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/spatialmath"
 	"go.viam.com/test"
 )
 
@@ -34,12 +50,17 @@ func TestFlow1(t *testing.T) {
 
 	focalLength := 30.0
 
-	l, a, err := computeFlow(a2, a1, time.Second, focalLength, logger)
+	res, err := computeFlow(a2, a1, time.Second, focalLength, nil, defaultTrackerParams, nil, logger)
 	test.That(t, err, test.ShouldBeNil)
+	l, a := res.linear, res.angular
+
+	logger.Infof("hi %v %v inliers: %d/%d", l, a, res.inliers, res.tracked)
 
-	logger.Infof("hi %v %v", l, a)
+	test.That(t, res.inliers, test.ShouldBeGreaterThan, 0)
+	test.That(t, res.inliers, test.ShouldBeLessThanOrEqualTo, res.tracked)
 
-	test.That(t, l.Z, test.ShouldAlmostEqual, 0)
+	// pa1 is closer to the door than pa2, so going from pa2 to it is forward
+	test.That(t, l.Z, test.ShouldBeGreaterThan, 0)
 	test.That(t, l.Y, test.ShouldBeGreaterThan, 0)
 
 	ratio := math.Abs(l.Y) / math.Abs(l.X)
@@ -50,4 +71,792 @@ func TestFlow1(t *testing.T) {
 	test.That(t, math.Abs(a.Z), test.ShouldBeGreaterThan, 0)
 	test.That(t, a.Z, test.ShouldAlmostEqual, 0, .1)
 
+	test.That(t, res.residual, test.ShouldBeGreaterThan, 0)
+	test.That(t, res.variance(1).known(), test.ShouldBeTrue)
+}
+
+func TestSolvePnPRansac(t *testing.T) {
+	k := intrinsics{focal: 500, cx: 320, cy: 240}
+	truth := pnpModel{
+		rvec: r3.Vector{Y: .05},
+		tvec: r3.Vector{X: .1, Z: -.2},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	obj := []gocv.Point3f{}
+	img := []gocv.Point2f{}
+	for i := 0; i < 60; i++ {
+		p := r3.Vector{X: rng.Float64()*2 - 1, Y: rng.Float64()*2 - 1, Z: 3 + rng.Float64()*3}
+		u, v, ok := k.project(truth.apply(p))
+		test.That(t, ok, test.ShouldBeTrue)
+		if i%6 == 0 {
+			// a bad match
+			u, v = rng.Float64()*640, rng.Float64()*480
+		}
+		obj = append(obj, gocv.Point3f{X: float32(p.X), Y: float32(p.Y), Z: float32(p.Z)})
+		img = append(img, gocv.Point2f{X: float32(u), Y: float32(v)})
+	}
+
+	m, inliers, err := solvePnPRansac(obj, img, k)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, inliers[0], test.ShouldBeFalse)
+	test.That(t, inliers[1], test.ShouldBeTrue)
+	test.That(t, m.rvec.Y, test.ShouldAlmostEqual, .05, .001)
+	test.That(t, m.tvec.X, test.ShouldAlmostEqual, .1, .005)
+	test.That(t, m.tvec.Z, test.ShouldAlmostEqual, -.2, .005)
+}
+
+func TestEstimateEssentialMotion(t *testing.T) {
+	rvec := r3.Vector{Y: .05, Z: .02}
+	tvec := r3.Vector{X: .1, Z: .3}
+
+	rng := rand.New(rand.NewSource(2))
+	a, b := []r2.Point{}, []r2.Point{}
+	for i := 0; i < 80; i++ {
+		p := r3.Vector{X: rng.Float64()*4 - 2, Y: rng.Float64()*2 - 1, Z: 2 + rng.Float64()*6}
+		q := rotate(rvec, p).Add(tvec)
+		a = append(a, r2.Point{X: p.X / p.Z, Y: p.Y / p.Z})
+		b = append(b, r2.Point{X: q.X / q.Z, Y: q.Y / q.Z})
+	}
+
+	m, inliers, err := estimateEssentialMotion(a, b, 500)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, inliers[0], test.ShouldBeTrue)
+	test.That(t, m.rvec.Y, test.ShouldAlmostEqual, rvec.Y, .001)
+	test.That(t, m.rvec.Z, test.ShouldAlmostEqual, rvec.Z, .001)
+	test.That(t, m.t.X, test.ShouldAlmostEqual, tvec.Normalize().X, .01)
+	test.That(t, m.t.Z, test.ShouldAlmostEqual, tvec.Normalize().Z, .01)
+	test.That(t, m.residual, test.ShouldBeLessThan, .01)
+	test.That(t, m.parallax, test.ShouldBeGreaterThan, 1)
+
+	// pure rotation has no translation direction
+	for i := range b {
+		q := rotate(rvec, r3.Vector{X: a[i].X, Y: a[i].Y, Z: 1})
+		b[i] = r2.Point{X: q.X / q.Z, Y: q.Y / q.Z}
+	}
+	m, _, err = estimateEssentialMotion(a, b, 500)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, m.t.Norm(), test.ShouldEqual, 0)
+	test.That(t, m.rvec.Y, test.ShouldAlmostEqual, rvec.Y, .001)
+}
+
+func TestSimilarityRansac(t *testing.T) {
+	center := r2.Point{X: 320, Y: 240}
+	truth := similarityMotion{theta: .02, scale: 1.01, t: r2.Point{X: 5, Y: -3}}
+
+	rng := rand.New(rand.NewSource(3))
+	prev, next := []r2.Point{}, []r2.Point{}
+	for i := 0; i < 50; i++ {
+		p := r2.Point{X: rng.Float64() * 640, Y: rng.Float64() * 480}
+		n := truth.apply(p, center)
+		if i%5 == 0 {
+			// someone walking through the view
+			n = n.Add(r2.Point{X: 30, Y: 10})
+		}
+		prev = append(prev, p)
+		next = append(next, n)
+	}
+
+	inliers := ransac(len(prev), 2, flowRansacIterations, flowInlierPixels,
+		func(idx []int) (similarityMotion, bool) {
+			return fitSimilarityMotion(prev, next, idx[0], idx[1], center)
+		},
+		func(m similarityMotion, i int) float64 {
+			return m.apply(prev[i], center).Sub(next[i]).Norm()
+		},
+	)
+	for i, in := range inliers {
+		test.That(t, in, test.ShouldEqual, i%5 != 0)
+	}
+}
+
+func TestDeadReckoning(t *testing.T) {
+	d := newDeadReckoning(geo.NewPoint(40, -74), 10, 0)
+
+	// turn right by 90 degrees, z points up
+	d.update(r3.Vector{}, spatialmath.AngularVelocity{Z: -math.Pi / 2}, 1)
+	// then drive forward 100m and climb 1m
+	d.update(r3.Vector{Y: 10, Z: .1}, spatialmath.AngularVelocity{}, 10)
+
+	p, alt := d.position()
+	test.That(t, alt, test.ShouldAlmostEqual, 11)
+	test.That(t, geo.NewPoint(40, -74).GreatCircleDistance(p)*1000, test.ShouldAlmostEqual, 100, .1)
+	test.That(t, geo.NewPoint(40, -74).BearingTo(p), test.ShouldAlmostEqual, 90, .1)
+}
+
+func TestHeadingEstimate(t *testing.T) {
+	h := &headingEstimate{heading: 350, seeded: true, timeConstant: 10}
+	h.update(20, 1)
+	test.That(t, h.heading, test.ShouldAlmostEqual, 10)
+
+	// pulled toward the compass the short way around, not through 180
+	for i := 0; i < 200; i++ {
+		h.correct(340, 1)
+	}
+	test.That(t, h.heading, test.ShouldAlmostEqual, 340, 0.01)
+
+	unseeded := &headingEstimate{timeConstant: 10}
+	unseeded.correct(123, 1)
+	test.That(t, unseeded.seeded, test.ShouldBeTrue)
+	test.That(t, unseeded.heading, test.ShouldAlmostEqual, 123)
+}
+
+func TestDerotate(t *testing.T) {
+	k := intrinsics{focal: 500, cx: 320, cy: 240}
+
+	// turning right, what is straight ahead now was off to the right before
+	theta := 0.1
+	p := k.derotate(r3.Vector{Y: theta}, r2.Point{X: 320, Y: 240})
+	test.That(t, p.X, test.ShouldAlmostEqual, 320+500*math.Tan(theta), 1e-6)
+	test.That(t, p.Y, test.ShouldAlmostEqual, 240, 1e-6)
+
+	// and undoing the turn gets back where it started
+	back := k.derotate(r3.Vector{Y: -theta}, p)
+	test.That(t, back.X, test.ShouldAlmostEqual, 320, 1e-6)
+	test.That(t, back.Y, test.ShouldAlmostEqual, 240, 1e-6)
+
+	fused := fuseAngular(spatialmath.AngularVelocity{Z: 1}, spatialmath.AngularVelocity{Z: 2}, 0.75)
+	test.That(t, fused.Z, test.ShouldAlmostEqual, 1.75)
+}
+
+func TestDownwardMount(t *testing.T) {
+	cfg := Config{Downward: true}
+	d := newDeadReckoning(geo.NewPoint(40, -74), 10, 0)
+
+	// the top of the image is forward, so moving that way is north, and turning about the optical axis is yaw
+	v, w := cfg.poseExtrinsics().toBase(r3.Vector{Y: -100}, spatialmath.AngularVelocity{Z: math.Pi / 2})
+	d.update(v, spatialmath.AngularVelocity{}, 1)
+	pt, alt := d.position()
+	test.That(t, pt.Lat(), test.ShouldBeGreaterThan, 40)
+	test.That(t, pt.Lng(), test.ShouldAlmostEqual, -74, 1e-9)
+	test.That(t, alt, test.ShouldAlmostEqual, 10, 1e-9)
+	test.That(t, yawRate(w), test.ShouldAlmostEqual, 90, 1e-9)
+
+	// looking forward, the optical axis is forward and the camera's y is down
+	v, w = (&Config{}).poseExtrinsics().toBase(r3.Vector{Z: 1}, spatialmath.AngularVelocity{Y: math.Pi / 2})
+	test.That(t, v.Y, test.ShouldAlmostEqual, 1, 1e-9)
+	test.That(t, yawRate(w), test.ShouldAlmostEqual, 90, 1e-9)
+}
+
+func TestVelocityHistory(t *testing.T) {
+	h := &velocityHistory{size: 5, order: 2}
+	start := time.Now()
+
+	_, ok := h.acceleration()
+	test.That(t, ok, test.ShouldBeFalse)
+
+	// unevenly spaced frames, accelerating at 2 m/s^2 along x while slowing at 0.5 along z
+	for _, s := range []float64{0, 0.1, 0.25, 0.3, 0.45, 0.5, 0.62} {
+		h.add(start.Add(time.Duration(s*float64(time.Second))), r3.Vector{X: 1 + 2*s, Z: 3 - 0.5*s}, time.Second)
+	}
+	test.That(t, len(h.samples), test.ShouldEqual, 5)
+	a, ok := h.acceleration()
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, a.X, test.ShouldAlmostEqual, 2, 1e-6)
+	test.That(t, a.Y, test.ShouldAlmostEqual, 0, 1e-6)
+	test.That(t, a.Z, test.ShouldAlmostEqual, -0.5, 1e-6)
+
+	// a long gap starts over
+	h.add(start.Add(5*time.Second), r3.Vector{}, time.Second)
+	_, ok = h.acceleration()
+	test.That(t, ok, test.ShouldBeFalse)
+}
+
+func TestFlowVariance(t *testing.T) {
+	r := flowResult{inliers: 25, residual: 1, linearPerPixel: .01, angularPerPixel: .002}
+	v := r.variance(.5)
+	test.That(t, v.known(), test.ShouldBeTrue)
+	test.That(t, math.Sqrt(v.linear), test.ShouldAlmostEqual, 1/5./.5*.01)
+	test.That(t, math.Sqrt(v.angular), test.ShouldAlmostEqual, 1/5./.5*.002)
+
+	// more inliers, longer between frames, and agreeing better are all more certain
+	more := r
+	more.inliers = 100
+	test.That(t, more.variance(.5).linear, test.ShouldBeLessThan, v.linear)
+	test.That(t, r.variance(1).linear, test.ShouldBeLessThan, v.linear)
+	tight := r
+	tight.residual = .5
+	test.That(t, tight.variance(.5).linear, test.ShouldBeLessThan, v.linear)
+
+	// but badly tracked features are less
+	blurry := r
+	blurry.trackError = flowTrackErrorScale
+	test.That(t, blurry.variance(.5).linear, test.ShouldAlmostEqual, 4*v.linear)
+
+	test.That(t, flowResult{}.variance(1).known(), test.ShouldBeFalse)
+}
+
+func TestSetParams(t *testing.T) {
+	levels := 2
+	cfg := &Config{Left: "left", LKPyramidLevels: &levels}
+	f := &flow{cfg: cfg, tuned: *cfg, params: cfg.loopParams()}
+	test.That(t, f.params.period, test.ShouldEqual, time.Second/30)
+	test.That(t, f.params.tracker.pyramidLevels, test.ShouldEqual, 2)
+
+	res, err := f.DoCommand(context.Background(), map[string]interface{}{
+		"set_params": map[string]interface{}{"rate-hz": 10.0, "max-corners": 200.0, "lk-pyramid-levels": 0.0},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["rate-hz"], test.ShouldAlmostEqual, 10)
+	test.That(t, f.params.period, test.ShouldEqual, 100*time.Millisecond)
+	test.That(t, f.params.tracker.maxCorners, test.ShouldEqual, 200)
+	test.That(t, f.params.tracker.pyramidLevels, test.ShouldEqual, 0)
+	test.That(t, f.params.tracker.qualityLevel, test.ShouldEqual, defaultTrackerParams.qualityLevel)
+	test.That(t, *cfg.LKPyramidLevels, test.ShouldEqual, 2)
+
+	// bad values and settings that need a restart change nothing
+	_, err = f.DoCommand(context.Background(), map[string]interface{}{"set_params": map[string]interface{}{"quality-level": 2.0}})
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = f.DoCommand(context.Background(), map[string]interface{}{"set_params": map[string]interface{}{"left": "other"}})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, f.params.period, test.ShouldEqual, 100*time.Millisecond)
+}
+
+func TestFeatureTracker(t *testing.T) {
+	ft := &featureTracker{tracks: []track{{pt: gocv.Point2f{X: 1, Y: 1}}, {pt: gocv.Point2f{X: 5, Y: 5}, age: 3}}}
+	ft.update([]gocv.Point2f{{X: 2, Y: 1}, {X: 6, Y: 5}}, []bool{true, true})
+	test.That(t, ft.meanAge(), test.ShouldAlmostEqual, 2.5)
+
+	// dropped tracks are gone, the rest keep moving and aging
+	ft.update([]gocv.Point2f{{X: 3, Y: 1}, {X: 7, Y: 5}}, []bool{false, true})
+	test.That(t, len(ft.tracks), test.ShouldEqual, 1)
+	test.That(t, ft.tracks[0], test.ShouldResemble, track{pt: gocv.Point2f{X: 7, Y: 5}, age: 5})
+
+	ft.reset()
+	test.That(t, ft.meanAge(), test.ShouldEqual, 0)
+
+	// no tracker is fine too
+	var none *featureTracker
+	none.update(nil, nil)
+	none.reset()
+	test.That(t, none.meanAge(), test.ShouldEqual, 0)
+
+	cells := gridCells(image.Rect(0, 0, 640, 480), 4)
+	test.That(t, len(cells), test.ShouldEqual, 16)
+	test.That(t, cells[0], test.ShouldResemble, image.Rect(0, 0, 160, 120))
+	test.That(t, cells[15], test.ShouldResemble, image.Rect(480, 360, 640, 480))
+
+	test.That(t, tooClose(gocv.Point2f{X: 10, Y: 10}, []gocv.Point2f{{X: 13, Y: 14}}, 6), test.ShouldBeTrue)
+	test.That(t, tooClose(gocv.Point2f{X: 10, Y: 10}, []gocv.Point2f{{X: 13, Y: 14}}, 5), test.ShouldBeFalse)
+}
+
+func TestTrimmedMean(t *testing.T) {
+	// one wild value, like something moving through a patch of floor
+	values := func() []float64 { return []float64{1, 2, 3, 4, 100} }
+	test.That(t, trimmedMean(values(), 0), test.ShouldAlmostEqual, 22)
+	test.That(t, trimmedMean(values(), 0.2), test.ShouldAlmostEqual, 3)
+	test.That(t, trimmedMean(values(), 0.5), test.ShouldAlmostEqual, 3)
+	test.That(t, trimmedMean([]float64{4, 1, 3, 2}, 0.5), test.ShouldAlmostEqual, 2.5)
+	test.That(t, trimmedMean(nil, 0.5), test.ShouldEqual, 0)
+
+	cfg := Config{Dense: true}
+	test.That(t, cfg.denseParams().trim, test.ShouldEqual, 0.5)
+	cfg.DenseAverage = "trimmed-mean"
+	test.That(t, cfg.denseParams().trim, test.ShouldEqual, 0.2)
+}
+
+func TestDenseFlow(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+
+	a1, err := read("data/pa1.jpg")
+	test.That(t, err, test.ShouldBeNil)
+
+	a2, err := read("data/pa2.jpg")
+	test.That(t, err, test.ShouldBeNil)
+
+	focalLength := 30.0
+	params := denseParams{step: 4, trim: 0.5}
+
+	res, err := computeDenseFlow(a2, a1, time.Second, focalLength, nil, params, logger)
+	test.That(t, err, test.ShouldBeNil)
+	l := res.linear
+
+	logger.Infof("dense %v %v inliers: %d/%d", l, res.angular, res.inliers, res.tracked)
+
+	test.That(t, res.inliers, test.ShouldBeGreaterThan, 0)
+	test.That(t, res.inliers, test.ShouldBeLessThanOrEqualTo, res.tracked)
+	test.That(t, res.tracked, test.ShouldEqual, (640/4)*(480/4))
+
+	// the same way the corners move in TestFlow1
+	test.That(t, l.Y, test.ShouldBeGreaterThan, 0)
+	test.That(t, math.Abs(l.Y), test.ShouldBeGreaterThan, math.Abs(l.X))
+	test.That(t, res.pixels, test.ShouldBeGreaterThan, 0)
+
+	// only the roi is used, and the field covers just it
+	roi := image.Rect(160, 120, 480, 360)
+	params.roi = &roi
+	res, err = computeDenseFlow(a2, a1, time.Second, focalLength, nil, params, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res.tracked, test.ShouldEqual, (320/4)*(240/4))
+	test.That(t, res.dense.roi, test.ShouldResemble, roi)
+	test.That(t, len(res.dense.data), test.ShouldEqual, 2*roi.Dx()*roi.Dy())
+	test.That(t, res.linear.Y, test.ShouldBeGreaterThan, 0)
+
+	// an roi hanging off the frame is cut down to it
+	roi = image.Rect(480, 360, 800, 600)
+	res, err = computeDenseFlow(a2, a1, time.Second, focalLength, nil, params, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res.dense.roi, test.ShouldResemble, image.Rect(480, 360, 640, 480))
+
+	roi = image.Rect(700, 500, 800, 600)
+	_, err = computeDenseFlow(a2, a1, time.Second, focalLength, nil, params, logger)
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestDebugImages(t *testing.T) {
+	test.That(t, hsv(0, 1, 1), test.ShouldResemble, color.RGBA{R: 255, A: 255})
+	test.That(t, hsv(120, 1, 1), test.ShouldResemble, color.RGBA{G: 255, A: 255})
+	test.That(t, hsv(240, 1, .5), test.ShouldResemble, color.RGBA{B: 128, A: 255})
+
+	// the right half moves right at full speed, the top left half as fast but down
+	field := denseField{roi: image.Rect(2, 0, 4, 2), data: []float32{2, 0, 1, 0, 0, 2, 0, 0}}
+	img := drawDense(image.Rect(0, 0, 4, 2), field)
+	test.That(t, img.At(2, 0), test.ShouldResemble, color.RGBA{R: 255, A: 255})
+	test.That(t, img.At(3, 0), test.ShouldResemble, color.RGBA{R: 128, A: 255})
+	test.That(t, img.At(2, 1), test.ShouldResemble, hsv(90, 1, 1))
+	test.That(t, img.At(3, 1), test.ShouldResemble, color.RGBA{A: 255})
+	test.That(t, img.At(0, 0), test.ShouldResemble, color.RGBA{A: 255})
+
+	res, err := encodeDebugImage(img)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["mime_type"], test.ShouldEqual, "image/jpeg")
+	test.That(t, res["width"], test.ShouldEqual, 4)
+
+	// tracking corners, the dense flow is worked out just for the image
+	a1, err := read("data/pa1.jpg")
+	test.That(t, err, test.ShouldBeNil)
+	a2, err := read("data/pa2.jpg")
+	test.That(t, err, test.ShouldBeNil)
+	f := &flow{cfg: &Config{Left: "left"}, logger: logging.NewTestLogger(t), lastKey: a2, lastFrame: a1}
+	res, err = f.DoCommand(context.Background(), map[string]interface{}{"debug_image": "dense"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["width"], test.ShouldEqual, 640)
+}
+
+func TestExtrinsics(t *testing.T) {
+	// looking forward, half a meter ahead of the center of a base with y forward and z up
+	cfg := Config{CameraPose: &CameraPose{
+		TranslationMeters: r3.Vector{Y: .5},
+		Orientation:       &spatialmath.OrientationVectorDegrees{OY: 1, Theta: -90},
+	}}
+	e := cfg.extrinsics()
+
+	v, w := e.toBase(r3.Vector{Z: 1}, spatialmath.AngularVelocity{})
+	test.That(t, v.Y, test.ShouldAlmostEqual, 1, 1e-9)
+	test.That(t, v.X, test.ShouldAlmostEqual, 0, 1e-9)
+	test.That(t, w, test.ShouldResemble, spatialmath.AngularVelocity{})
+
+	// turning left in place swings the camera to its left, but the base isn't going anywhere
+	v, w = e.toBase(r3.Vector{X: -.5}, spatialmath.AngularVelocity{Y: -1})
+	test.That(t, v.Norm(), test.ShouldAlmostEqual, 0, 1e-9)
+	test.That(t, w.Z, test.ShouldAlmostEqual, 1, 1e-9)
+
+	// without a pose it's the camera frame
+	v, _ = (&Config{}).extrinsics().toBase(r3.Vector{X: 1}, spatialmath.AngularVelocity{})
+	test.That(t, v, test.ShouldResemble, r3.Vector{X: 1})
+
+	// the lever arm is in meters, so it's only used when the velocities are too
+	f := &flow{cfg: &cfg}
+	test.That(t, f.extrinsics().lever, test.ShouldResemble, r3.Vector{})
+	cfg.Downward = true
+	test.That(t, f.extrinsics().lever, test.ShouldResemble, r3.Vector{Y: .5})
+}
+
+func TestFrameStats(t *testing.T) {
+	s := frameStats{}
+	start := time.Now()
+	captured := func(i int) time.Time { return start.Add(time.Duration(i) * 33 * time.Millisecond) }
+
+	s.add(captured(0), start, time.Second)
+	s.add(captured(1), start.Add(50*time.Millisecond), time.Second)
+	test.That(t, s.dropped, test.ShouldEqual, 0)
+	test.That(t, s.rate, test.ShouldAlmostEqual, 20, 1e-9)
+
+	// processing fell behind and two frames went by
+	s.add(captured(4), start.Add(150*time.Millisecond), time.Second)
+	test.That(t, s.dropped, test.ShouldEqual, 2)
+	test.That(t, s.rate, test.ShouldAlmostEqual, 0.8*20+0.2*10, 1e-9)
+
+	// the camera stopping isn't dropping frames
+	s.add(captured(100), start.Add(5*time.Second), time.Second)
+	test.That(t, s.dropped, test.ShouldEqual, 2)
+}
+
+func TestEstimateHistory(t *testing.T) {
+	h := (&Config{HistorySize: 3}).newEstimateHistory()
+	test.That(t, h.recent(0), test.ShouldBeEmpty)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		h.add(historyEntry{captured: start.Add(time.Duration(i) * time.Second), inliers: i})
+	}
+	all := h.recent(0)
+	test.That(t, len(all), test.ShouldEqual, 3)
+	for i, e := range all {
+		test.That(t, e.inliers, test.ShouldEqual, i+2)
+	}
+
+	last := h.recent(2)
+	test.That(t, len(last), test.ShouldEqual, 2)
+	test.That(t, last[1].inliers, test.ShouldEqual, 4)
+	test.That(t, last[1].toMap()["latencyMs"], test.ShouldEqual, 0.0)
+}
+
+// fakeCamera hands out frames in turn, each captured when it is asked for, or at captured if set
+type fakeCamera struct {
+	camera.Camera
+
+	lock     sync.Mutex
+	frames   []image.Image
+	captured []time.Time
+	n        int
+}
+
+func (c *fakeCamera) Images(ctx context.Context) ([]camera.NamedImage, resource.ResponseMetadata, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n++
+	meta := resource.ResponseMetadata{CapturedAt: time.Now()}
+	if c.captured != nil {
+		meta.CapturedAt = c.captured[c.n%len(c.captured)]
+	}
+	return []camera.NamedImage{{Image: c.frames[c.n%len(c.frames)]}}, meta, nil
+}
+
+// TestConcurrentAccess runs the loop against a fake camera while calling everything else, run it with -race
+func TestConcurrentAccess(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+
+	cam := &fakeCamera{}
+	for _, fn := range []string{"data/pa1.jpg", "data/pa2.jpg"} {
+		img, err := read(fn)
+		test.That(t, err, test.ShouldBeNil)
+		cam.frames = append(cam.frames, img)
+	}
+	deps := resource.Dependencies{camera.Named("left"): cam}
+
+	ms, err := NewFlow(context.Background(), deps, movementsensor.Named("flow"), &Config{Left: "left", RateHz: 100}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	defer ms.Close(context.Background())
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ms.LinearVelocity(ctx, nil)
+				ms.AngularVelocity(ctx, nil)
+				ms.Position(ctx, nil)
+				ms.Accuracy(ctx, nil)
+				// test.That can't fail the test from here
+				res, err := ms.Readings(ctx, nil)
+				if err == nil {
+					_, err = protoutils.ReadingGoToProto(res)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				ms.DoCommand(ctx, map[string]interface{}{"history": 10.0})
+				ms.DoCommand(ctx, map[string]interface{}{"set_speed": 1.0})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the loop keeps going on its own, so wait for it to have made an estimate
+	var history []interface{}
+	for deadline := time.Now().Add(5 * time.Second); len(history) == 0 && time.Now().Before(deadline); {
+		res, err := ms.DoCommand(ctx, map[string]interface{}{"history": 0.0})
+		test.That(t, err, test.ShouldBeNil)
+		history = res["history"].([]interface{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.That(t, history, test.ShouldNotBeEmpty)
+}
+
+func TestNewKeyframe(t *testing.T) {
+	p := (&Config{}).loopParams()
+	key := keyframe{inliers: 100}
+
+	// creeping along, keep measuring from the keyframe
+	test.That(t, p.newKeyframe(key, flowResult{pixels: 0.3, inliers: 90}, 100*time.Millisecond), test.ShouldBeFalse)
+	// far enough to measure
+	test.That(t, p.newKeyframe(key, flowResult{pixels: 2.5, inliers: 90}, 100*time.Millisecond), test.ShouldBeTrue)
+	// losing the features
+	test.That(t, p.newKeyframe(key, flowResult{pixels: 0.3, inliers: 40}, 100*time.Millisecond), test.ShouldBeTrue)
+	// about to be too old
+	test.That(t, p.newKeyframe(key, flowResult{pixels: 0.3, inliers: 90}, 600*time.Millisecond), test.ShouldBeTrue)
+
+	zero := 0.0
+	p = (&Config{KeyframePixels: &zero}).loopParams()
+	test.That(t, p.newKeyframe(key, flowResult{inliers: 90}, 100*time.Millisecond), test.ShouldBeTrue)
+
+	ft := &featureTracker{tracks: []track{{age: 1}, {age: 3}}}
+	c := ft.clone()
+	c.update([]gocv.Point2f{{}, {}}, []bool{true, false})
+	test.That(t, len(ft.tracks), test.ShouldEqual, 2)
+	test.That(t, ft.meanAge(), test.ShouldEqual, 2)
+	test.That(t, c.meanAge(), test.ShouldEqual, 2)
+}
+
+func TestSimilarityScale(t *testing.T) {
+	prev := []r2.Point{{X: 100, Y: 100}, {X: 200, Y: 100}, {X: 200, Y: 200}, {X: 100, Y: 200}, {X: 150, Y: 150}}
+	inliers := []bool{true, true, true, true, false}
+
+	next := make([]r2.Point, len(prev))
+	sin, cos := math.Sincos(0.1)
+	for i, p := range prev {
+		d := p.Sub(r2.Point{X: 150, Y: 150}).Mul(1.25)
+		next[i] = r2.Point{X: d.X*cos - d.Y*sin + 160, Y: d.X*sin + d.Y*cos + 140}
+	}
+	next[4] = r2.Point{X: 500, Y: 10}
+
+	test.That(t, similarityScale(prev, next, inliers), test.ShouldAlmostEqual, 1.25, 1e-9)
+	test.That(t, similarityScale(prev, prev, inliers), test.ShouldAlmostEqual, 1, 1e-9)
+	test.That(t, similarityScale(prev[:1], next[:1], inliers[:1]), test.ShouldEqual, 1)
+}
+
+func TestExpansion(t *testing.T) {
+	focus := r2.Point{X: 400, Y: 200}
+	bounds := image.Rect(0, 0, 640, 480)
+
+	// moving forward, everything grows by a tenth a second, so it is 10 seconds away
+	vectors := []flowVector{}
+	for x := 20.0; x < 640; x += 60 {
+		for y := 20.0; y < 480; y += 60 {
+			p := r2.Point{X: x, Y: y}
+			vectors = append(vectors, flowVector{from: p, to: focus.Add(p.Sub(focus).Mul(1.1)), inlier: true})
+		}
+	}
+	e := newExpansion(vectors, 1, bounds)
+	test.That(t, e, test.ShouldNotBeNil)
+	test.That(t, e.focus.X, test.ShouldAlmostEqual, 400, 1e-6)
+	test.That(t, e.focus.Y, test.ShouldAlmostEqual, 200, 1e-6)
+	test.That(t, len(e.timeToContact), test.ShouldEqual, 9)
+	for _, ttc := range e.timeToContact {
+		test.That(t, ttc, test.ShouldAlmostEqual, 10, 1e-6)
+	}
+
+	// something in the bottom left twice as close, and someone in the middle walking at the camera,
+	// which doesn't fit the camera's motion
+	for i, v := range vectors {
+		if v.from.X < 213 && v.from.Y >= 320 {
+			vectors[i].to = focus.Add(v.from.Sub(focus).Mul(1.2))
+		}
+		if v.from.X >= 213 && v.from.X <= 320 && v.from.Y >= 160 && v.from.Y < 320 {
+			vectors[i].to = focus.Add(v.from.Sub(focus).Mul(3))
+			vectors[i].inlier = false
+		}
+	}
+	e = newExpansion(vectors, 1, bounds)
+	test.That(t, e.timeToContact[6], test.ShouldAlmostEqual, 5, 1e-6)
+	test.That(t, e.timeToContact[4], test.ShouldAlmostEqual, 10, 1e-6)
+
+	// moving sideways there is no focus
+	for i, v := range vectors {
+		vectors[i].to = v.from.Add(r2.Point{X: 5})
+	}
+	test.That(t, newExpansion(vectors, 1, bounds), test.ShouldBeNil)
+}
+
+func TestStationaryDetector(t *testing.T) {
+	s := (&Config{StationaryFrames: 3}).newStationaryDetector()
+
+	test.That(t, s.update(0.05, nil), test.ShouldBeFalse)
+	test.That(t, s.update(0.05, nil), test.ShouldBeFalse)
+	test.That(t, s.update(0.05, nil), test.ShouldBeTrue)
+
+	// moving again
+	test.That(t, s.update(2, nil), test.ShouldBeFalse)
+	test.That(t, s.stationary(), test.ShouldBeFalse)
+
+	// the camera sees nothing, but the imu is turning
+	turning := spatialmath.AngularVelocity{Z: 0.1}
+	for i := 0; i < 5; i++ {
+		test.That(t, s.update(0.05, &turning), test.ShouldBeFalse)
+	}
+	still := spatialmath.AngularVelocity{Z: 0.001}
+	for i := 0; i < 3; i++ {
+		s.update(0.05, &still)
+	}
+	test.That(t, s.stationary(), test.ShouldBeTrue)
+
+	bias := r3.Vector{}
+	for i := 0; i < 100; i++ {
+		bias = updateBias(bias, still)
+	}
+	test.That(t, bias.Z, test.ShouldAlmostEqual, 0.001, 1e-6)
+}
+
+func TestStationaryIgnoresInliers(t *testing.T) {
+	img, err := read("data/pa1.jpg")
+	test.That(t, err, test.ShouldBeNil)
+
+	for _, frames := range []int{1, 10} {
+		// nothing moves, but there will never be this many inliers
+		cfg := &Config{Left: "left", MinInliers: 100000, StationaryFrames: frames}
+		cam := &fakeCamera{frames: []image.Image{img}}
+		f := &flow{
+			cfg:        cfg,
+			logger:     logging.NewTestLogger(t),
+			left:       cam,
+			cancelCtx:  context.Background(),
+			pose:       cfg.newDeadReckoning(),
+			heading:    cfg.newHeadingEstimate(),
+			velocities: cfg.newVelocityHistory(),
+			history:    cfg.newEstimateHistory(),
+			stationary: cfg.newStationaryDetector(),
+			params:     cfg.loopParams(),
+		}
+		state := loopState{tracks: &featureTracker{}}
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			cam.captured = []time.Time{start.Add(time.Duration(i) * 30 * time.Millisecond)}
+			err = f.doLoop(&state)
+		}
+		if frames == 1 {
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, f.linear, test.ShouldResemble, r3.Vector{})
+		} else {
+			test.That(t, err, test.ShouldNotBeNil)
+		}
+	}
+}
+
+func TestReadingsSerialize(t *testing.T) {
+	cfg := &Config{Left: "left"}
+	f := &flow{
+		cfg:        cfg,
+		logger:     logging.NewTestLogger(t),
+		pose:       cfg.newDeadReckoning(),
+		heading:    cfg.newHeadingEstimate(),
+		velocities: cfg.newVelocityHistory(),
+		history:    cfg.newEstimateHistory(),
+		stationary: cfg.newStationaryDetector(),
+		variance:   flowVariance{linear: 0.01, angular: 0.02},
+		params:     cfg.loopParams(),
+		lastUpdate: time.Now(),
+		angular:    spatialmath.AngularVelocity{Z: math.Pi},
+		lastResult: flowResult{
+			tracked:   10,
+			inliers:   8,
+			expansion: &expansion{timeToContact: []float64{0, 2, 0, 0, 0, 0, 0, 0, 0}},
+		},
+	}
+
+	res, err := f.Readings(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["lastError"], test.ShouldBeNil)
+	test.That(t, res["linear_velocity"], test.ShouldNotBeNil)
+	// in degrees per second, like any other movement sensor
+	test.That(t, res["angular_velocity"].(spatialmath.AngularVelocity).Z, test.ShouldAlmostEqual, 180)
+	_, err = protoutils.ReadingGoToProto(res)
+	test.That(t, err, test.ShouldBeNil)
+
+	f.lastError = errors.New("no images")
+	res, err = f.Readings(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, res["lastError"], test.ShouldEqual, "no images")
+	test.That(t, res["linear_velocity"], test.ShouldBeNil)
+	_, err = protoutils.ReadingGoToProto(res)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestPositionNeedsMeters(t *testing.T) {
+	cfg := &Config{Left: "left"}
+	f := &flow{
+		cfg:        cfg,
+		pose:       cfg.newDeadReckoning(),
+		params:     cfg.loopParams(),
+		lastUpdate: time.Now(),
+	}
+
+	// the legacy estimator's velocity is over the distance to the scene
+	_, _, err := f.Position(context.Background(), nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	props, err := f.Properties(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, props.PositionSupported, test.ShouldBeFalse)
+
+	cfg.Downward = true
+	_, _, err = f.Position(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+
+	cfg.Downward = false
+	cfg.BaselineMeters = .06
+	_, _, err = f.Position(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+
+	// ego motion only has a direction until it's given a speed
+	cfg.BaselineMeters = 0
+	cfg.FocalLengthPixels = 500
+	test.That(t, f.metric(), test.ShouldBeFalse)
+	cfg.EgoMotion = true
+	_, _, err = f.Position(context.Background(), nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = f.LinearVelocity(context.Background(), nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = f.DoCommand(context.Background(), map[string]interface{}{"set_speed": .4})
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = f.Position(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+	_, err = f.LinearVelocity(context.Background(), nil)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestLegacyHeading(t *testing.T) {
+	logger := logging.NewTestLogger(t)
+
+	img, err := read("data/pa1.jpg")
+	test.That(t, err, test.ShouldBeNil)
+	crop := func(x int) image.Image {
+		c := image.NewRGBA(image.Rect(0, 0, 600, img.Bounds().Dy()))
+		draw.Draw(c, c.Bounds(), img, image.Pt(x, 0), draw.Src)
+		return c
+	}
+
+	// turning right, the scene moves left
+	cfg := &Config{Left: "left", FocalLengh: 500}
+	f := &flow{cfg: cfg, logger: logger}
+	r, err := f.estimate(keyframe{image: crop(0)}, &keyframe{image: crop(10)}, nil, time.Second, nil, defaultTrackerParams)
+	test.That(t, err, test.ShouldBeNil)
+
+	// it only turns the heading, the velocities stay what the camera saw
+	test.That(t, r.angular.Y, test.ShouldEqual, 0)
+	test.That(t, cfg.flowHeading(), test.ShouldBeTrue)
+	h := cfg.newHeadingEstimate()
+	h.update(flowYawRate(r.linear), 1)
+	test.That(t, h.heading, test.ShouldAlmostEqual, 10.0/500*180/math.Pi, .2)
+
+	// not knowing how the camera is mounted, or the real focal length, the motion could be anything
+	test.That(t, (&Config{Left: "left"}).flowHeading(), test.ShouldBeFalse)
+	cfg.CameraPose = &CameraPose{}
+	test.That(t, cfg.flowHeading(), test.ShouldBeFalse)
+}
+
+func TestNewFramesOnly(t *testing.T) {
+	img, err := read("data/pa1.jpg")
+	test.That(t, err, test.ShouldBeNil)
+
+	for _, captured := range []time.Time{time.Now(), {}} {
+		// the same frame twice, with the same or no capture time
+		cam := &fakeCamera{frames: []image.Image{img}, captured: []time.Time{captured}}
+		cfg := &Config{Left: "left"}
+		f := &flow{
+			cfg:       cfg,
+			logger:    logging.NewTestLogger(t),
+			left:      cam,
+			cancelCtx: context.Background(),
+			params:    cfg.loopParams(),
+		}
+		state := loopState{tracks: &featureTracker{}}
+
+		test.That(t, f.doLoop(&state), test.ShouldBeNil)
+		first := state.lastCaptured
+		test.That(t, f.doLoop(&state), test.ShouldEqual, errNoNewFrame)
+		test.That(t, state.lastCaptured, test.ShouldEqual, first)
+	}
 }
@@ -0,0 +1,43 @@
+package flow
+
+import (
+	"math"
+)
+
+// headingEstimate integrates yaw rate into a compass heading, and if there is a magnetometer,
+// pulls it slowly toward that so it neither drifts forever nor jumps with magnetic noise
+type headingEstimate struct {
+	heading      float64 // degrees clockwise from north, in [0, 360)
+	seeded       bool    // false until there is a heading to start from
+	timeConstant float64 // seconds it takes to mostly settle on the magnetometer
+}
+
+// wrap360 returns the angle in degrees in [0, 360)
+func wrap360(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+// wrap180 returns the angle in degrees in [-180, 180)
+func wrap180(deg float64) float64 {
+	return wrap360(deg+180) - 180
+}
+
+// update turns the heading by rate degrees per second over dt seconds
+func (h *headingEstimate) update(rate, dt float64) {
+	h.heading = wrap360(h.heading + rate*dt)
+}
+
+// correct moves the heading toward a magnetometer reading, dt seconds after the last one
+func (h *headingEstimate) correct(compass, dt float64) {
+	if !h.seeded {
+		h.heading = wrap360(compass)
+		h.seeded = true
+		return
+	}
+	alpha := dt / (dt + h.timeConstant)
+	h.heading = wrap360(h.heading + alpha*wrap180(compass-h.heading))
+}
@@ -0,0 +1,55 @@
+package flow
+
+import (
+	"time"
+
+	"github.com/golang/geo/r3"
+
+	"go.viam.com/rdk/spatialmath"
+)
+
+// historyEntry is one estimate, for looking back at how the sensor has been doing
+type historyEntry struct {
+	captured time.Time // when the frame was captured
+	linear   r3.Vector
+	angular  spatialmath.AngularVelocity
+	tracked  int
+	inliers  int
+	latency  time.Duration // from the frame being captured to the estimate being ready
+}
+
+func (e historyEntry) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"time":      e.captured.Format(time.RFC3339Nano),
+		"linear":    map[string]interface{}{"x": e.linear.X, "y": e.linear.Y, "z": e.linear.Z},
+		"angular":   map[string]interface{}{"x": e.angular.X, "y": e.angular.Y, "z": e.angular.Z},
+		"tracked":   e.tracked,
+		"inliers":   e.inliers,
+		"latencyMs": float64(e.latency) / float64(time.Millisecond),
+	}
+}
+
+// estimateHistory is a ring buffer of the last size estimates
+type estimateHistory struct {
+	entries []historyEntry
+	next    int // where the next one goes once entries is full
+	size    int
+}
+
+func (h *estimateHistory) add(e historyEntry) {
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % h.size
+}
+
+// recent returns the last n estimates oldest first, all of them if n isn't positive
+func (h *estimateHistory) recent(n int) []historyEntry {
+	all := append(append([]historyEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+	if n > 0 && n < len(all) {
+		return all[len(all)-n:]
+	}
+	return all
+}
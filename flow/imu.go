@@ -0,0 +1,25 @@
+package flow
+
+import (
+	"github.com/golang/geo/r2"
+	"github.com/golang/geo/r3"
+
+	"go.viam.com/rdk/spatialmath"
+)
+
+// derotate moves pixel p to where it would have been seen if the camera had not turned by rvec,
+// so what's left of a feature's motion comes from translation alone
+func (k intrinsics) derotate(rvec r3.Vector, p r2.Point) r2.Point {
+	x, y, ok := k.project(rotate(rvec, k.unproject(p.X, p.Y, 1)))
+	if !ok {
+		return p
+	}
+	return r2.Point{X: x, Y: y}
+}
+
+// fuseAngular is a complementary filter, trusting the gyro by weight and the camera by the rest.
+// The gyro is good at short term rotation, and the camera keeps it honest about bias.
+func fuseAngular(visual, gyro spatialmath.AngularVelocity, weight float64) spatialmath.AngularVelocity {
+	v := r3.Vector(visual).Mul(1 - weight).Add(r3.Vector(gyro).Mul(weight))
+	return spatialmath.AngularVelocity(v)
+}
@@ -2,16 +2,22 @@ package flow
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"math"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/golang/geo/r2"
 	"github.com/golang/geo/r3"
 	geo "github.com/kellydunn/golang-geo"
 
 	"go.viam.com/rdk/components/camera"
 	"go.viam.com/rdk/components/movementsensor"
+	"go.viam.com/rdk/components/sensor"
 	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/resource"
 	"go.viam.com/rdk/spatialmath"
@@ -33,6 +39,343 @@ type Config struct {
 	Left       string
 	Right      string
 	FocalLengh float64 `json:"focal-length"`
+
+	// BaselineMeters is the distance between the rectified left and right cameras.
+	// If set, features are triangulated with the stereo pair, and velocities are in meters per second.
+	BaselineMeters float64 `json:"baseline-meters"`
+
+	// FocalLengthPixels is the focal length of the rectified left camera, needed for baseline-meters.
+	FocalLengthPixels float64 `json:"focal-length-pixels"`
+
+	// EgoMotion turns on full 6 degree of freedom motion from the left camera alone, which needs focal-length-pixels,
+	// where linear velocity is the direction of travel scaled by the speed given with set_speed.
+	EgoMotion bool `json:"ego-motion"`
+
+	// MinInliers and MinInlierRatio make a frame pair an error instead of a velocity
+	// when too few tracked features agree on the motion
+	MinInliers     int     `json:"min-inliers"`
+	MinInlierRatio float64 `json:"min-inlier-ratio"`
+
+	// Velocities are integrated into a pose relative to the start, which Position places at the origin,
+	// with the camera facing OriginHeading degrees clockwise from north
+	OriginLatitude       float64 `json:"origin-latitude"`
+	OriginLongitude      float64 `json:"origin-longitude"`
+	OriginAltitudeMeters float64 `json:"origin-altitude-meters"`
+	OriginHeading        float64 `json:"origin-heading"`
+
+	// Compass is an optional movement sensor with a compass heading, like a magnetometer.
+	// CompassHeading starts from it instead of origin-heading, and is pulled toward it
+	// over CompassTimeConstantSec seconds.
+	Compass                string  `json:"compass"`
+	CompassTimeConstantSec float64 `json:"compass-time-constant-sec"`
+
+	// IMU is an optional movement sensor with angular velocity, mounted with the same axes as the camera.
+	// Its rotation is taken out of the tracked features before finding translation, and its
+	// angular velocity is blended with the camera's, trusting the imu by IMUWeight. It needs focal-length-pixels.
+	IMU       string  `json:"imu"`
+	IMUWeight float64 `json:"imu-weight"`
+
+	// The camera is taken to be stationary, with exactly zero velocity, once features have moved less than
+	// StationaryPixels a frame, on average since the keyframe, for StationaryFrames frames in a row, and the imu
+	// if there is one turns slower than StationaryDegsPerSec. While stationary, the imu's angular velocity is
+	// its bias, and is taken off from then on.
+	StationaryPixels     float64 `json:"stationary-pixels"`
+	StationaryFrames     int     `json:"stationary-frames"`
+	StationaryDegsPerSec float64 `json:"stationary-degs-per-sec"`
+
+	// Downward is for a camera looking straight down at the ground, with the top of the image toward the front.
+	// Features are followed across the ground, and scaled to meters per second by the distance to it, which comes
+	// from the Rangefinder sensor's "distance" reading in meters, or HeightMeters if there is none or it fails.
+	// It needs focal-length-pixels.
+	Downward     bool    `json:"downward"`
+	HeightMeters float64 `json:"height-meters"`
+	Rangefinder  string  `json:"rangefinder"`
+
+	// CameraPose is where the camera is on the base, LinearVelocity, AngularVelocity and LinearAcceleration
+	// are for the base in its frame with it, instead of for the camera in the camera frame
+	CameraPose *CameraPose `json:"camera-pose"`
+
+	// Dense uses Farneback dense optical flow instead of tracking corners, for surfaces without any.
+	// The motion is the median over DenseROI of every DenseStep-th pixel, or with DenseAverage "trimmed-mean",
+	// the mean after cutting off DenseTrim of them at each end.
+	Dense        bool             `json:"dense"`
+	DenseROI     *image.Rectangle `json:"dense-roi"`
+	DenseStep    int              `json:"dense-step"`
+	DenseAverage string           `json:"dense-average"`
+	DenseTrim    float64          `json:"dense-trim"`
+
+	// LinearAcceleration is the slope of a polynomial of AccelerationOrder fit to the last AccelerationWindow
+	// velocities, more of them is smoother but lags more
+	AccelerationWindow int `json:"acceleration-window"`
+	AccelerationOrder  int `json:"acceleration-order"`
+
+	// HistorySize is how many of the last estimates the history DoCommand can return
+	HistorySize int `json:"history-size"`
+
+	// RateHz is the most times a second to look for motion, every new frame is used up to that, and
+	// frames or velocities older than StaleThresholdSec aren't used. These, KeyframePixels and the
+	// feature tracking settings can be changed while running with set_params.
+	RateHz            float64 `json:"rate-hz"`
+	StaleThresholdSec float64 `json:"stale-threshold-sec"`
+
+	// KeyframePixels is how far features have to move before motion is measured from a newer frame,
+	// so slow motion isn't lost in noise, 0 measures from the last frame every time
+	KeyframePixels *float64 `json:"keyframe-pixels"`
+
+	// feature tracking, see trackerParams
+	MaxCorners      int     `json:"max-corners"`
+	QualityLevel    float64 `json:"quality-level"`
+	MinDistance     float64 `json:"min-distance"`
+	LKWindowSize    int     `json:"lk-window-size"`
+	LKPyramidLevels *int    `json:"lk-pyramid-levels"`
+	LKMaxIterations int     `json:"lk-max-iterations"`
+	LKEpsilon       float64 `json:"lk-epsilon"`
+
+	MinTracks             int     `json:"min-tracks"`
+	GridSize              int     `json:"grid-size"`
+	ForwardBackwardPixels float64 `json:"forward-backward-pixels"`
+}
+
+// CameraPose is the camera's position in meters and orientation in the base frame,
+// with the orientation vector pointing where the camera looks, like in a Viam frame
+type CameraPose struct {
+	TranslationMeters r3.Vector                             `json:"translation-meters"`
+	Orientation       *spatialmath.OrientationVectorDegrees `json:"orientation"`
+}
+
+func (cfg *Config) extrinsics() extrinsics {
+	if cfg.CameraPose == nil {
+		return extrinsics{}
+	}
+	e := extrinsics{lever: cfg.CameraPose.TranslationMeters}
+	if cfg.CameraPose.Orientation != nil {
+		e.rvec = spatialmath.QuatToR3AA(cfg.CameraPose.Orientation.Quaternion())
+	}
+	return e
+}
+
+// tunableParams are the config keys set_params can change
+var tunableParams = []string{
+	"rate-hz", "stale-threshold-sec", "keyframe-pixels",
+	"max-corners", "quality-level", "min-distance",
+	"lk-window-size", "lk-pyramid-levels", "lk-max-iterations", "lk-epsilon",
+	"min-tracks", "grid-size", "forward-backward-pixels",
+}
+
+// loopParams are the settings that can be changed while running
+type loopParams struct {
+	period         time.Duration
+	stale          time.Duration
+	keyframePixels float64
+	tracker        trackerParams
+}
+
+func (cfg *Config) loopParams() loopParams {
+	p := loopParams{
+		period:         time.Second / 30,
+		stale:          time.Second,
+		keyframePixels: 2,
+		tracker:        defaultTrackerParams,
+	}
+	if cfg.RateHz > 0 {
+		p.period = time.Duration(float64(time.Second) / cfg.RateHz)
+	}
+	if cfg.StaleThresholdSec > 0 {
+		p.stale = time.Duration(cfg.StaleThresholdSec * float64(time.Second))
+	}
+	if cfg.KeyframePixels != nil {
+		p.keyframePixels = *cfg.KeyframePixels
+	}
+	if cfg.MaxCorners > 0 {
+		p.tracker.maxCorners = cfg.MaxCorners
+	}
+	if cfg.QualityLevel > 0 {
+		p.tracker.qualityLevel = cfg.QualityLevel
+	}
+	if cfg.MinDistance > 0 {
+		p.tracker.minDistance = cfg.MinDistance
+	}
+	if cfg.LKWindowSize > 0 {
+		p.tracker.windowSize = cfg.LKWindowSize
+	}
+	if cfg.LKPyramidLevels != nil {
+		p.tracker.pyramidLevels = *cfg.LKPyramidLevels
+	}
+	if cfg.LKMaxIterations > 0 {
+		p.tracker.maxIterations = cfg.LKMaxIterations
+	}
+	if cfg.LKEpsilon > 0 {
+		p.tracker.epsilon = cfg.LKEpsilon
+	}
+	if cfg.MinTracks > 0 {
+		p.tracker.minTracks = cfg.MinTracks
+	}
+	if cfg.GridSize > 0 {
+		p.tracker.gridSize = cfg.GridSize
+	}
+	if cfg.ForwardBackwardPixels > 0 {
+		p.tracker.forwardBackward = cfg.ForwardBackwardPixels
+	}
+	return p
+}
+
+// validateParams checks the settings that can be changed while running
+func (cfg *Config) validateParams() error {
+	if cfg.RateHz < 0 {
+		return fmt.Errorf("rate-hz cannot be negative")
+	}
+	if cfg.StaleThresholdSec < 0 {
+		return fmt.Errorf("stale-threshold-sec cannot be negative")
+	}
+	if cfg.KeyframePixels != nil && *cfg.KeyframePixels < 0 {
+		return fmt.Errorf("keyframe-pixels cannot be negative")
+	}
+	if cfg.MaxCorners < 0 {
+		return fmt.Errorf("max-corners cannot be negative")
+	}
+	if cfg.QualityLevel < 0 || cfg.QualityLevel > 1 {
+		return fmt.Errorf("quality-level has to be between 0 and 1")
+	}
+	if cfg.MinDistance < 0 {
+		return fmt.Errorf("min-distance cannot be negative")
+	}
+	if cfg.LKWindowSize != 0 && cfg.LKWindowSize < 3 {
+		return fmt.Errorf("lk-window-size has to be at least 3")
+	}
+	if cfg.LKPyramidLevels != nil && *cfg.LKPyramidLevels < 0 {
+		return fmt.Errorf("lk-pyramid-levels cannot be negative")
+	}
+	if cfg.LKMaxIterations < 0 {
+		return fmt.Errorf("lk-max-iterations cannot be negative")
+	}
+	if cfg.LKEpsilon < 0 {
+		return fmt.Errorf("lk-epsilon cannot be negative")
+	}
+	if cfg.MinTracks < 0 || cfg.GridSize < 0 || cfg.ForwardBackwardPixels < 0 {
+		return fmt.Errorf("min-tracks, grid-size and forward-backward-pixels cannot be negative")
+	}
+	return nil
+}
+
+func (cfg *Config) getAccelerationWindow() int {
+	if cfg.AccelerationWindow <= 0 {
+		return 5
+	}
+	return cfg.AccelerationWindow
+}
+
+func (cfg *Config) getAccelerationOrder() int {
+	if cfg.AccelerationOrder <= 0 {
+		return 2
+	}
+	return cfg.AccelerationOrder
+}
+
+func (cfg *Config) newVelocityHistory() *velocityHistory {
+	return &velocityHistory{size: cfg.getAccelerationWindow(), order: cfg.getAccelerationOrder()}
+}
+
+func (cfg *Config) getHistorySize() int {
+	if cfg.HistorySize <= 0 {
+		return 100
+	}
+	return cfg.HistorySize
+}
+
+func (cfg *Config) newEstimateHistory() *estimateHistory {
+	return &estimateHistory{size: cfg.getHistorySize()}
+}
+
+// poseExtrinsics is how the camera is mounted for dead reckoning, which needs the base frame. Without a
+// camera-pose, the camera is taken to be at the center of the base looking forward, or with downward,
+// looking down with the top of the image forward.
+func (cfg *Config) poseExtrinsics() extrinsics {
+	if cfg.CameraPose != nil {
+		return cfg.extrinsics()
+	}
+	if cfg.Downward {
+		// the camera's y is toward the back and z is down
+		return extrinsics{rvec: r3.Vector{X: math.Pi}}
+	}
+	return extrinsics{rvec: spatialmath.QuatToR3AA((&spatialmath.OrientationVectorDegrees{OY: 1, Theta: -90}).Quaternion())}
+}
+
+func (cfg *Config) getIMUWeight() float64 {
+	if cfg.IMUWeight <= 0 {
+		return 0.98
+	}
+	return cfg.IMUWeight
+}
+
+func (cfg *Config) newStationaryDetector() *stationaryDetector {
+	s := &stationaryDetector{pixels: 0.1, frames: 5, turn: 1 * math.Pi / 180}
+	if cfg.StationaryPixels > 0 {
+		s.pixels = cfg.StationaryPixels
+	}
+	if cfg.StationaryFrames > 0 {
+		s.frames = cfg.StationaryFrames
+	}
+	if cfg.StationaryDegsPerSec > 0 {
+		s.turn = cfg.StationaryDegsPerSec * math.Pi / 180
+	}
+	return s
+}
+
+func (cfg *Config) getCompassTimeConstantSec() float64 {
+	if cfg.CompassTimeConstantSec <= 0 {
+		return 30
+	}
+	return cfg.CompassTimeConstantSec
+}
+
+func (cfg *Config) newHeadingEstimate() *headingEstimate {
+	return &headingEstimate{
+		heading:      wrap360(cfg.OriginHeading),
+		seeded:       cfg.Compass == "",
+		timeConstant: cfg.getCompassTimeConstantSec(),
+	}
+}
+
+func (cfg *Config) newDeadReckoning() *deadReckoning {
+	return newDeadReckoning(geo.NewPoint(cfg.OriginLatitude, cfg.OriginLongitude), cfg.OriginAltitudeMeters, cfg.OriginHeading)
+}
+
+func (cfg *Config) stereo() bool {
+	return cfg.BaselineMeters > 0
+}
+
+func (cfg *Config) egoMotion() bool {
+	return cfg.EgoMotion
+}
+
+func (cfg *Config) denseParams() denseParams {
+	p := denseParams{roi: cfg.DenseROI, step: 4, trim: 0.5}
+	if cfg.DenseStep > 0 {
+		p.step = cfg.DenseStep
+	}
+	if cfg.DenseAverage == "trimmed-mean" {
+		p.trim = 0.2
+		if cfg.DenseTrim > 0 {
+			p.trim = cfg.DenseTrim
+		}
+	}
+	return p
+}
+
+// getIntrinsics returns the left camera intrinsics for images of the given size, assuming a centered principal point
+func (cfg *Config) getIntrinsics(bounds image.Rectangle) intrinsics {
+	return intrinsics{
+		focal: cfg.FocalLengthPixels,
+		cx:    float64(bounds.Dx()) / 2,
+		cy:    float64(bounds.Dy()) / 2,
+	}
+}
+
+// flowHeading is whether CompassHeading turns with features moving across the view. The legacy estimator only
+// sees roll, but looking forward from a base that can't slide sideways, that motion is the base turning, and
+// with focal-length set to the real focal length it is in radians.
+func (cfg *Config) flowHeading() bool {
+	return cfg.CameraPose == nil && cfg.FocalLengh > 0 && !cfg.stereo() && !cfg.egoMotion() && !cfg.Downward
 }
 
 func (cfg *Config) getFocalLength() float64 {
@@ -42,15 +385,143 @@ func (cfg *Config) getFocalLength() float64 {
 	return cfg.FocalLengh
 }
 
+// checkInliers returns an error if too few features agreed on the motion to trust it
+func (cfg *Config) checkInliers(r flowResult) error {
+	if r.inliers < cfg.MinInliers {
+		return fmt.Errorf("only %d inliers, need %d", r.inliers, cfg.MinInliers)
+	}
+	if r.inlierRatio() < cfg.MinInlierRatio {
+		return fmt.Errorf("inlier ratio %0.2f (%d of %d) is below %0.2f", r.inlierRatio(), r.inliers, r.tracked, cfg.MinInlierRatio)
+	}
+	return nil
+}
+
 func (cfg *Config) Validate(path string) ([]string, error) {
 	if cfg.Left == "" {
 		return nil, fmt.Errorf("need left")
 	}
-	if cfg.Right == "" {
-		return nil, fmt.Errorf("need right")
+
+	if cfg.BaselineMeters < 0 {
+		return nil, fmt.Errorf("baseline-meters cannot be negative")
+	}
+	if cfg.FocalLengthPixels < 0 {
+		return nil, fmt.Errorf("focal-length-pixels cannot be negative")
+	}
+	if cfg.stereo() {
+		if cfg.Right == "" {
+			return nil, fmt.Errorf("need right for baseline-meters")
+		}
+		if cfg.FocalLengthPixels <= 0 {
+			return nil, fmt.Errorf("need focal-length-pixels for baseline-meters")
+		}
+	}
+
+	if cfg.EgoMotion {
+		if cfg.stereo() || cfg.Downward || cfg.Dense {
+			return nil, fmt.Errorf("ego-motion does not work with baseline-meters, downward or dense")
+		}
+		if cfg.FocalLengthPixels <= 0 {
+			return nil, fmt.Errorf("need focal-length-pixels for ego-motion")
+		}
+	}
+
+	if cfg.HeightMeters < 0 {
+		return nil, fmt.Errorf("height-meters cannot be negative")
+	}
+	if cfg.Downward {
+		if cfg.stereo() {
+			return nil, fmt.Errorf("downward does not work with baseline-meters")
+		}
+		if cfg.FocalLengthPixels <= 0 {
+			return nil, fmt.Errorf("need focal-length-pixels for downward")
+		}
+		if cfg.HeightMeters <= 0 && cfg.Rangefinder == "" {
+			return nil, fmt.Errorf("need height-meters or rangefinder for downward")
+		}
+	}
+
+	if cfg.CameraPose != nil && cfg.CameraPose.Orientation != nil {
+		o := cfg.CameraPose.Orientation
+		if o.OX == 0 && o.OY == 0 && o.OZ == 0 {
+			return nil, fmt.Errorf("camera-pose orientation needs a direction")
+		}
+	}
+
+	if cfg.Dense {
+		if cfg.stereo() {
+			return nil, fmt.Errorf("dense does not work with baseline-meters")
+		}
+		if cfg.DenseROI != nil && cfg.DenseROI.Empty() {
+			return nil, fmt.Errorf("dense-roi %v is empty", *cfg.DenseROI)
+		}
+		if cfg.DenseStep < 0 {
+			return nil, fmt.Errorf("dense-step cannot be negative")
+		}
+		if cfg.DenseAverage != "" && cfg.DenseAverage != "median" && cfg.DenseAverage != "trimmed-mean" {
+			return nil, fmt.Errorf("dense-average has to be median or trimmed-mean, not %s", cfg.DenseAverage)
+		}
+		if cfg.DenseTrim < 0 || cfg.DenseTrim >= 0.5 {
+			return nil, fmt.Errorf("dense-trim has to be at least 0 and less than 0.5")
+		}
+	}
+
+	if cfg.OriginLatitude < -90 || cfg.OriginLatitude > 90 {
+		return nil, fmt.Errorf("origin-latitude has to be between -90 and 90")
+	}
+	if cfg.OriginLongitude < -180 || cfg.OriginLongitude > 180 {
+		return nil, fmt.Errorf("origin-longitude has to be between -180 and 180")
+	}
+
+	if cfg.CompassTimeConstantSec < 0 {
+		return nil, fmt.Errorf("compass-time-constant-sec cannot be negative")
+	}
+
+	if cfg.IMUWeight < 0 || cfg.IMUWeight > 1 {
+		return nil, fmt.Errorf("imu-weight has to be between 0 and 1")
+	}
+	if cfg.IMU != "" && cfg.FocalLengthPixels <= 0 {
+		return nil, fmt.Errorf("need focal-length-pixels for imu")
+	}
+
+	if cfg.StationaryPixels < 0 || cfg.StationaryFrames < 0 || cfg.StationaryDegsPerSec < 0 {
+		return nil, fmt.Errorf("stationary-pixels, stationary-frames and stationary-degs-per-sec cannot be negative")
 	}
 
-	return []string{cfg.Left, cfg.Right}, nil
+	if cfg.AccelerationWindow < 0 || cfg.AccelerationOrder < 0 {
+		return nil, fmt.Errorf("acceleration-window and acceleration-order cannot be negative")
+	}
+	if cfg.HistorySize < 0 {
+		return nil, fmt.Errorf("history-size cannot be negative")
+	}
+	if cfg.getAccelerationWindow() <= cfg.getAccelerationOrder() {
+		return nil, fmt.Errorf("need acceleration-window bigger than acceleration-order")
+	}
+
+	if err := cfg.validateParams(); err != nil {
+		return nil, err
+	}
+
+	if cfg.MinInliers < 0 {
+		return nil, fmt.Errorf("min-inliers cannot be negative")
+	}
+	if cfg.MinInlierRatio < 0 || cfg.MinInlierRatio > 1 {
+		return nil, fmt.Errorf("min-inlier-ratio has to be between 0 and 1")
+	}
+
+	deps := []string{cfg.Left}
+	if cfg.Right != "" {
+		deps = append(deps, cfg.Right)
+	}
+	if cfg.Compass != "" {
+		deps = append(deps, cfg.Compass)
+	}
+	if cfg.IMU != "" {
+		deps = append(deps, cfg.IMU)
+	}
+	if cfg.Rangefinder != "" {
+		deps = append(deps, cfg.Rangefinder)
+	}
+	return deps, nil
 }
 
 type flow struct {
@@ -65,12 +536,33 @@ type flow struct {
 	cancelFunc func()
 
 	left, right camera.Camera
+	compass     movementsensor.MovementSensor
+	imu         movementsensor.MovementSensor
+	rangefinder sensor.Sensor
 
 	dataLock   sync.Mutex
 	linear     r3.Vector
 	angular    spatialmath.AngularVelocity
 	lastUpdate time.Time
 	lastError  error
+	lastResult flowResult
+	lastFrame  image.Image
+	lastKey    image.Image // what lastFrame's motion was measured from
+	variance   flowVariance
+	frames     frameStats
+	pose       *deadReckoning
+	heading    *headingEstimate
+	velocities *velocityHistory
+	history    *estimateHistory
+	stationary *stationaryDetector
+
+	// tuned is the config with set_params applied, and params comes from it
+	tuned  Config
+	params loopParams
+
+	// speed scales the direction of travel from monocular ego motion once hasSpeed, see set_speed
+	speed    float64
+	hasSpeed bool
 }
 
 func newFlow(ctx context.Context, deps resource.Dependencies, rawConf resource.Config, logger logging.Logger) (movementsensor.MovementSensor, error) {
@@ -93,6 +585,14 @@ func NewFlow(ctx context.Context, deps resource.Dependencies, name resource.Name
 		cfg:        conf,
 		cancelCtx:  cancelCtx,
 		cancelFunc: cancelFunc,
+		pose:       conf.newDeadReckoning(),
+		heading:    conf.newHeadingEstimate(),
+		velocities: conf.newVelocityHistory(),
+		history:    conf.newEstimateHistory(),
+		stationary: conf.newStationaryDetector(),
+		variance:   unknownVariance,
+		tuned:      *conf,
+		params:     conf.loopParams(),
 	}
 
 	var err error
@@ -100,9 +600,29 @@ func NewFlow(ctx context.Context, deps resource.Dependencies, name resource.Name
 	if err != nil {
 		return nil, err
 	}
-	f.right, err = camera.FromDependencies(deps, conf.Right)
-	if err != nil {
-		return nil, err
+	if conf.Right != "" {
+		f.right, err = camera.FromDependencies(deps, conf.Right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Compass != "" {
+		f.compass, err = movementsensor.FromDependencies(deps, conf.Compass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.IMU != "" {
+		f.imu, err = movementsensor.FromDependencies(deps, conf.IMU)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Rangefinder != "" {
+		f.rangefinder, err = sensor.FromDependencies(deps, conf.Rangefinder)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	go f.run()
@@ -115,82 +635,399 @@ func (f *flow) Name() resource.Name {
 }
 
 func (f *flow) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if v, ok := cmd["set_speed"]; ok {
+		speed, ok := v.(float64)
+		if !ok || speed < 0 {
+			return nil, fmt.Errorf("set_speed needs a speed in meters per second, got %v", v)
+		}
+		f.dataLock.Lock()
+		defer f.dataLock.Unlock()
+		f.speed = speed
+		f.hasSpeed = true
+		return map[string]interface{}{"speed": speed}, nil
+	}
+
+	if _, ok := cmd["reset_pose"]; ok {
+		f.dataLock.Lock()
+		defer f.dataLock.Unlock()
+		f.pose = f.cfg.newDeadReckoning()
+		f.heading = f.cfg.newHeadingEstimate()
+		return map[string]interface{}{}, nil
+	}
+
+	if v, ok := cmd["set_pose"]; ok {
+		return f.setPose(v)
+	}
+
+	if v, ok := cmd["set_params"]; ok {
+		return f.setParams(v)
+	}
+
+	if v, ok := cmd["debug_image"]; ok {
+		return f.debugImage(v)
+	}
+
+	if v, ok := cmd["history"]; ok {
+		return f.recentHistory(v)
+	}
+
 	return nil, nil
 }
 
+// debugImage draws the last frame with its tracks, or for "dense" the dense flow, as a base64 jpeg
+func (f *flow) debugImage(v interface{}) (map[string]interface{}, error) {
+	f.dataLock.Lock()
+	frame, key, r := f.lastFrame, f.lastKey, f.lastResult
+	f.dataLock.Unlock()
+
+	if frame == nil {
+		return nil, fmt.Errorf("no frame to draw yet")
+	}
+
+	if v == "dense" {
+		field := r.dense
+		if field == nil {
+			// tracking corners, so work out the dense flow over the same frames just for this
+			d, err := computeDenseFlow(key, frame, time.Second, 1, nil, f.cfg.denseParams(), f.logger)
+			if err != nil {
+				return nil, err
+			}
+			field = d.dense
+		}
+		return encodeDebugImage(drawDense(image.Rect(0, 0, frame.Bounds().Dx(), frame.Bounds().Dy()), *field))
+	}
+
+	img, err := drawTracks(frame, r.vectors)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDebugImage(img)
+}
+
+// recentHistory returns the last n estimates oldest first, all that are kept if v isn't a number
+func (f *flow) recentHistory(v interface{}) (map[string]interface{}, error) {
+	n, _ := v.(float64)
+
+	f.dataLock.Lock()
+	entries := f.history.recent(int(n))
+	f.dataLock.Unlock()
+
+	history := make([]interface{}, len(entries))
+	for i, e := range entries {
+		history[i] = e.toMap()
+	}
+	return map[string]interface{}{"history": history}, nil
+}
+
+// setParams changes loop and tracking settings while running, using the same keys as the config
+func (f *flow) setParams(v interface{}) (map[string]interface{}, error) {
+	args, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("set_params needs an object, got %v", v)
+	}
+	for k := range args {
+		if !slices.Contains(tunableParams, k) {
+			return nil, fmt.Errorf("%s cannot be set while running, only %v", k, tunableParams)
+		}
+	}
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+
+	// unmarshaling would write through the pointers shared with f.tuned
+	tuned := f.tuned
+	if tuned.LKPyramidLevels != nil {
+		levels := *tuned.LKPyramidLevels
+		tuned.LKPyramidLevels = &levels
+	}
+	if tuned.KeyframePixels != nil {
+		pixels := *tuned.KeyframePixels
+		tuned.KeyframePixels = &pixels
+	}
+	if err := json.Unmarshal(data, &tuned); err != nil {
+		return nil, fmt.Errorf("bad set_params: %w", err)
+	}
+	if err := tuned.validateParams(); err != nil {
+		return nil, err
+	}
+	f.tuned = tuned
+	f.params = tuned.loopParams()
+
+	return tuned.paramsMap(), nil
+}
+
+// paramsMap returns the settings set_params can change, as they are used
+func (cfg *Config) paramsMap() map[string]interface{} {
+	p := cfg.loopParams()
+	return map[string]interface{}{
+		"rate-hz":                 float64(time.Second) / float64(p.period),
+		"stale-threshold-sec":     p.stale.Seconds(),
+		"keyframe-pixels":         p.keyframePixels,
+		"max-corners":             p.tracker.maxCorners,
+		"quality-level":           p.tracker.qualityLevel,
+		"min-distance":            p.tracker.minDistance,
+		"lk-window-size":          p.tracker.windowSize,
+		"lk-pyramid-levels":       p.tracker.pyramidLevels,
+		"lk-max-iterations":       p.tracker.maxIterations,
+		"lk-epsilon":              p.tracker.epsilon,
+		"min-tracks":              p.tracker.minTracks,
+		"grid-size":               p.tracker.gridSize,
+		"forward-backward-pixels": p.tracker.forwardBackward,
+	}
+}
+
+// setPose starts dead reckoning over from the given latitude, longitude, altitude and heading,
+// anything not given stays where it was
+func (f *flow) setPose(v interface{}) (map[string]interface{}, error) {
+	args, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("set_pose needs an object, got %v", v)
+	}
+
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+
+	pos, alt := f.pose.position()
+	lat, lng, heading := pos.Lat(), pos.Lng(), f.pose.heading
+	for k, dst := range map[string]*float64{"latitude": &lat, "longitude": &lng, "altitude": &alt, "heading": &heading} {
+		raw, ok := args[k]
+		if !ok {
+			continue
+		}
+		n, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("set_pose %s needs a number, got %v", k, raw)
+		}
+		*dst = n
+	}
+
+	f.pose = newDeadReckoning(geo.NewPoint(lat, lng), alt, heading)
+	if _, ok := args["heading"]; ok {
+		f.heading.heading = wrap360(heading)
+		f.heading.seeded = true
+	}
+	return map[string]interface{}{"latitude": lat, "longitude": lng, "altitude": alt, "heading": heading}, nil
+}
+
 func (f *flow) Close(context.Context) error {
 	f.cancelFunc()
 	return nil
 }
 
+// metric is whether linear velocity is in meters per second, so integrating it gives a position.
+// f.dataLock has to be held.
+func (f *flow) metric() bool {
+	return f.cfg.stereo() || f.cfg.Downward || (f.cfg.egoMotion() && f.hasSpeed)
+}
+
+// extrinsics is the config's extrinsics, without the lever arm unless the velocities are in meters per second
+// like it is, f.dataLock has to be held
+func (f *flow) extrinsics() extrinsics {
+	e := f.cfg.extrinsics()
+	if !f.metric() {
+		e.lever = r3.Vector{}
+	}
+	return e
+}
+
+// needSpeed is why there is no linear velocity yet, if there isn't, f.dataLock has to be held
+func (f *flow) needSpeed() error {
+	if f.cfg.egoMotion() && !f.hasSpeed {
+		return errors.New("need a speed from set_speed, a single camera only sees the direction of travel")
+	}
+	return nil
+}
+
 func (f *flow) Position(ctx context.Context, extra map[string]interface{}) (*geo.Point, float64, error) {
-	return nil, 0, movementsensor.ErrMethodUnimplementedPosition
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	if !f.metric() {
+		return nil, 0, errors.New("position needs velocity in meters per second, " +
+			"from baseline-meters, downward, or focal-length-pixels with set_speed")
+	}
+	p, alt := f.pose.position()
+	return p, alt, f.tooOld()
 }
 
 func (f *flow) LinearVelocity(ctx context.Context, extra map[string]interface{}) (r3.Vector, error) {
 	f.dataLock.Lock()
 	defer f.dataLock.Unlock()
+	if err := f.needSpeed(); err != nil {
+		return r3.Vector{}, err
+	}
 	return f.linear, f.tooOld()
 }
 
 func (f *flow) AngularVelocity(ctx context.Context, extra map[string]interface{}) (spatialmath.AngularVelocity, error) {
 	f.dataLock.Lock()
 	defer f.dataLock.Unlock()
-	return f.angular, f.tooOld()
+	return toDegrees(f.angular), f.tooOld()
 }
 
 func (f *flow) LinearAcceleration(ctx context.Context, extra map[string]interface{}) (r3.Vector, error) {
-	return r3.Vector{}, movementsensor.ErrMethodUnimplementedLinearAcceleration
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	if err := f.needSpeed(); err != nil {
+		return r3.Vector{}, err
+	}
+	a, ok := f.velocities.acceleration()
+	if !ok {
+		return r3.Vector{}, fmt.Errorf("not enough velocities for acceleration yet")
+	}
+	return a, f.tooOld()
 }
 
 func (f *flow) CompassHeading(ctx context.Context, extra map[string]interface{}) (float64, error) {
-	return 0, movementsensor.ErrMethodUnimplementedCompassHeading
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	if !f.heading.seeded {
+		return 0, fmt.Errorf("no reading from compass %s to start from yet", f.cfg.Compass)
+	}
+	return f.heading.heading, f.tooOld()
 }
 
 func (f *flow) Orientation(ctx context.Context, extra map[string]interface{}) (spatialmath.Orientation, error) {
-	return nil, movementsensor.ErrMethodUnimplementedOrientation
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	return f.pose.pose.Orientation(), f.tooOld()
 }
 
 func (f *flow) Properties(ctx context.Context, extra map[string]interface{}) (*movementsensor.Properties, error) {
 	return &movementsensor.Properties{
-		LinearVelocitySupported:  true,
-		AngularVelocitySupported: true,
+		PositionSupported:           f.cfg.stereo() || f.cfg.Downward || f.cfg.egoMotion(),
+		CompassHeadingSupported:     true,
+		LinearAccelerationSupported: true,
+		OrientationSupported:        true,
+		LinearVelocitySupported:     true,
+		AngularVelocitySupported:    true,
 	}, nil
 
 }
 
 func (f *flow) Accuracy(ctx context.Context, extra map[string]interface{}) (*movementsensor.Accuracy, error) {
-	return &movementsensor.Accuracy{}, nil
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	acc := movementsensor.UnimplementedOptionalAccuracies()
+	acc.AccuracyMap = map[string]float32{
+		"residualPixels": float32(f.lastResult.residual),
+		"trackError":     float32(f.lastResult.trackError),
+	}
+	if f.variance.known() {
+		acc.AccuracyMap["linearVelocityStdDev"] = float32(math.Sqrt(f.variance.linear))
+		acc.AccuracyMap["angularVelocityStdDev"] = float32(math.Sqrt(f.variance.angular) * 180 / math.Pi)
+	}
+	return acc, nil
 }
 
+// Readings has whichever movement sensor readings are available, so one that isn't doesn't hide the rest,
+// and how the flow is doing. Everything has to be something a protobuf Struct can hold.
 func (f *flow) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
-	res, err := movementsensor.DefaultAPIReadings(ctx, f, extra)
-	if res != nil {
-		res["lastUpdate"] = f.lastUpdate
-		res["lastError"] = f.lastError
+	res := map[string]interface{}{}
+	if pos, alt, err := f.Position(ctx, extra); err == nil {
+		res["position"] = pos
+		res["altitude"] = alt
+	}
+	if v, err := f.LinearVelocity(ctx, extra); err == nil {
+		res["linear_velocity"] = v
+	}
+	if a, err := f.LinearAcceleration(ctx, extra); err == nil {
+		res["linear_acceleration"] = a
+	}
+	if av, err := f.AngularVelocity(ctx, extra); err == nil {
+		res["angular_velocity"] = av
+	}
+	if h, err := f.CompassHeading(ctx, extra); err == nil {
+		res["compass"] = h
+	}
+	if o, err := f.Orientation(ctx, extra); err == nil {
+		res["orientation"] = o
 	}
-	return res, err
 
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	res["lastUpdate"] = f.lastUpdate.Format(time.RFC3339Nano)
+	res["lastError"] = nil
+	if f.lastError != nil {
+		res["lastError"] = f.lastError.Error()
+	}
+	res["tracked"] = f.lastResult.tracked
+	res["inliers"] = f.lastResult.inliers
+	res["inlierRatio"] = f.lastResult.inlierRatio()
+	res["residualPixels"] = f.lastResult.residual
+	res["trackError"] = f.lastResult.trackError
+	res["meanTrackAge"] = f.lastResult.trackAge
+	res["processingRateHz"] = f.frames.rate
+	res["droppedFrames"] = f.frames.dropped
+	res["is_stationary"] = f.stationary.stationary()
+	if e := f.lastResult.expansion; e != nil {
+		res["focusOfExpansion"] = map[string]interface{}{"x": e.focus.X, "y": e.focus.Y}
+		ttc := make([]interface{}, len(e.timeToContact))
+		for i, t := range e.timeToContact {
+			if t > 0 {
+				ttc[i] = t
+			}
+		}
+		res["timeToContactSec"] = ttc
+	}
+	if f.variance.known() {
+		res["linearVelocityCovariance"] = diagonal(f.variance.linear)
+		res["angularVelocityCovariance"] = diagonal(f.variance.angular * math.Pow(180/math.Pi, 2))
+	}
+	return res, nil
 }
 
+// tooOld returns why the estimates shouldn't be used, if they shouldn't, f.dataLock has to be held
 func (f *flow) tooOld() error {
 	if f.lastError != nil {
 		return f.lastError
 	}
 	diff := time.Since(f.lastUpdate)
-	if diff > time.Second {
+	if diff > f.params.stale {
 		return fmt.Errorf("no update since %v : ago : %v", f.lastUpdate, diff)
 	}
 	return nil
 }
 
+// keyframe is the frame motion is measured from
+type keyframe struct {
+	image    image.Image
+	right    image.Image
+	captured time.Time
+	height   float64 // meters to the ground in downward mode, 0 if not known
+	inliers  int     // inliers the first time it was measured from, to see tracking get worse
+	frames   int     // frames measured from it so far
+}
+
 type loopState struct {
-	lastImage     image.Image
-	lastImageTime time.Time
+	key          keyframe
+	lastCaptured time.Time // the last frame looked at, keyframe or not
+	tracks       *featureTracker
+	gyroBias     r3.Vector // radians per second the imu reads when not turning
+
+	lastFingerprint uint64 // of the last frame, for cameras that don't say when they captured it
+}
+
+// newKeyframe returns true if motion should be measured from the frame r was measured to from now on,
+// because it has moved far enough for pixel noise not to matter, tracking is getting worse, or key is
+// getting close to too old to use
+func (p loopParams) newKeyframe(key keyframe, r flowResult, diff time.Duration) bool {
+	return r.pixels >= p.keyframePixels || r.inliers <= key.inliers/2 || diff > p.stale/2
 }
 
+// errNoNewFrame is when the camera still has the frame that was processed last
+var errNoNewFrame = errors.New("no new frame")
+
 func (f *flow) doLoop(state *loopState) error {
-	f.logger.Infof("starting loop")
+	f.logger.Debugf("starting loop")
+
+	f.dataLock.Lock()
+	params := f.params
+	f.dataLock.Unlock()
 
 	leftAll, meta, err := f.left.Images(f.cancelCtx)
 	if err != nil {
@@ -200,43 +1037,325 @@ func (f *flow) doLoop(state *loopState) error {
 		return fmt.Errorf("no images")
 	}
 
-	defer func() {
-		state.lastImage = leftAll[0].Image
-		state.lastImageTime = meta.CapturedAt
-	}()
+	captured := meta.CapturedAt
+	if captured.IsZero() {
+		// the camera doesn't say, so a frame is new if it looks different
+		fp := fingerprint(leftAll[0].Image)
+		if state.key.image != nil && fp == state.lastFingerprint {
+			return errNoNewFrame
+		}
+		state.lastFingerprint = fp
+		captured = time.Now()
+	}
+	if !captured.After(state.lastCaptured) {
+		return errNoNewFrame
+	}
+
+	f.dataLock.Lock()
+	f.frames.add(captured, time.Now(), params.stale)
+	f.dataLock.Unlock()
 
-	diff := meta.CapturedAt.Sub(state.lastImageTime)
-	if state.lastImage == nil || diff > time.Second {
+	var right image.Image
+	if f.cfg.stereo() {
+		rightAll, _, err := f.right.Images(f.cancelCtx)
+		if err != nil {
+			return err
+		}
+		if len(rightAll) == 0 {
+			return fmt.Errorf("no right images")
+		}
+		right = rightAll[0].Image
+	}
+
+	next := keyframe{image: leftAll[0].Image, right: right, captured: captured}
+	step := captured.Sub(state.lastCaptured)
+	state.lastCaptured = captured
+
+	diff := captured.Sub(state.key.captured)
+	if state.key.image == nil || diff > params.stale {
+		state.tracks.reset()
+		state.key = next
 		f.logger.Infof("no old image or too old")
 		return nil
 	}
 
-	f.logger.Infof("starting flow computation")
-	l, a, err := computeFlow(state.lastImage, leftAll[0].Image, diff, f.cfg.getFocalLength(), f.logger)
+	rawGyro := f.readIMU()
+	var gyro *spatialmath.AngularVelocity
+	if rawGyro != nil {
+		g := spatialmath.AngularVelocity(r3.Vector(*rawGyro).Sub(state.gyroBias))
+		gyro = &g
+	}
+
+	// the tracks only move on with the keyframe, until then they are tracked from it again
+	tracks := state.tracks.clone()
+
+	f.logger.Debugf("starting flow computation")
+	keyImage := state.key.image
+	r, err := f.estimate(state.key, &next, tracks, diff, gyro, params.tracker)
+	r.trackAge = tracks.meanAge()
 	if err != nil {
+		state.tracks.reset()
+		state.key = next
 		f.logger.Infof("error computing flow")
 		return err
 	}
 
-	f.logger.Infof("got %v %v", l, a)
+	if state.key.inliers == 0 {
+		state.key.inliers = r.inliers
+	}
+	// how far the features move a frame, on average since the keyframe
+	state.key.frames++
+	stepPixels := r.pixels / float64(state.key.frames)
+	if params.newKeyframe(state.key, r, diff) {
+		state.key = next
+		state.tracks = tracks
+	}
+
+	f.logger.Debugf("got %v %v inliers: %d/%d", r.linear, r.angular, r.inliers, r.tracked)
+
+	compassHeading, compassOk := f.readCompass()
 
 	f.dataLock.Lock()
 	defer f.dataLock.Unlock()
-	f.linear = l
-	f.angular = a
+	f.lastResult = r
+	f.lastFrame = leftAll[0].Image
+	f.lastKey = keyImage
+	f.variance = r.variance(diff.Seconds())
+
+	// parked, the little motion there is is jitter, and integrating it would drift.
+	// The inliers aren't checked then, so parked facing a blank wall is still stationary.
+	stationary := f.stationary.update(stepPixels, gyro)
+	if stationary {
+		if rawGyro != nil {
+			state.gyroBias = updateBias(state.gyroBias, *rawGyro)
+		}
+		r.linear, r.angular = r3.Vector{}, spatialmath.AngularVelocity{}
+	} else if err := f.cfg.checkInliers(r); err != nil {
+		return err
+	}
+
+	f.linear, f.angular = f.extrinsics().toBase(r.linear, r.angular)
 	f.lastUpdate = time.Now()
 
+	// the pose is in the base frame, which is f.linear and f.angular with a camera-pose
+	baseLinear, baseAngular := f.linear, f.angular
+	if f.cfg.CameraPose == nil {
+		baseLinear, baseAngular = f.cfg.poseExtrinsics().toBase(r.linear, r.angular)
+	}
+	// velocities are over diff, since the keyframe, but only step has gone by since the last frame
+	f.pose.update(baseLinear, baseAngular, step.Seconds())
+	if f.needSpeed() == nil {
+		// without a speed the velocity is zero, which would look like stopping once there is one
+		f.velocities.add(captured, f.linear, params.stale)
+	}
+	f.history.add(historyEntry{
+		captured: captured,
+		linear:   f.linear,
+		angular:  toDegrees(f.angular),
+		tracked:  r.tracked,
+		inliers:  r.inliers,
+		latency:  f.lastUpdate.Sub(captured),
+	})
+
+	yaw := yawRate(baseAngular)
+	if gyro == nil && f.cfg.flowHeading() {
+		yaw = flowYawRate(r.linear)
+	}
+	f.heading.update(yaw, step.Seconds())
+	if compassOk {
+		f.heading.correct(compassHeading, step.Seconds())
+	}
+
 	return nil
 }
 
+// readCompass returns the heading from the compass dependency, false if there is none or it failed
+func (f *flow) readCompass() (float64, bool) {
+	if f.compass == nil {
+		return 0, false
+	}
+	h, err := f.compass.CompassHeading(f.cancelCtx, nil)
+	if err != nil {
+		f.logger.Debugf("cannot read compass %s: %v", f.cfg.Compass, err)
+		return 0, false
+	}
+	return h, true
+}
+
+// readIMU returns the angular velocity from the imu dependency in radians per second,
+// nil if there is none or it failed, in which case the camera is used alone
+func (f *flow) readIMU() *spatialmath.AngularVelocity {
+	if f.imu == nil {
+		return nil
+	}
+	av, err := f.imu.AngularVelocity(f.cancelCtx, nil)
+	if err != nil {
+		f.logger.Warnf("cannot read imu %s: %v", f.cfg.IMU, err)
+		return nil
+	}
+	rad := spatialmath.AngularVelocity(r3.Vector(av).Mul(math.Pi / 180))
+	return &rad
+}
+
+// estimate runs whichever estimator the config asks for from key to next, diff apart, following tracks,
+// using the gyro's angular velocity if there is one
+func (f *flow) estimate(key keyframe, next *keyframe, tracks *featureTracker, diff time.Duration,
+	gyro *spatialmath.AngularVelocity, tracker trackerParams) (flowResult, error) {
+	now := next.image
+	if f.cfg.stereo() {
+		k := f.cfg.getIntrinsics(now.Bounds())
+		r, err := computeStereoFlow(key.image, key.right, now, diff, k, f.cfg.BaselineMeters, tracker, tracks, f.logger)
+		if err == nil && gyro != nil {
+			r.angular = fuseAngular(r.angular, *gyro, f.cfg.getIMUWeight())
+		}
+		return r, err
+	}
+
+	if f.cfg.egoMotion() {
+		k := f.cfg.getIntrinsics(now.Bounds())
+		r, err := computeEgoMotion(key.image, now, diff, k, tracker, tracks, f.logger)
+		if err != nil {
+			return r, err
+		}
+		if gyro != nil {
+			r.angular = fuseAngular(r.angular, *gyro, f.cfg.getIMUWeight())
+		}
+		f.dataLock.Lock()
+		r.linear = r.linear.Mul(f.speed)
+		r.linearPerPixel *= f.speed
+		f.dataLock.Unlock()
+		return r, nil
+	}
+
+	focal := f.cfg.getFocalLength()
+	if f.cfg.Downward {
+		focal = f.cfg.FocalLengthPixels
+	}
+
+	// the legacy estimator only sees rotation about the optical axis, so with a gyro the rotation
+	// is taken out of the features first, using the real focal length, and what turning is left is the
+	// gyro being off
+	var derotate func(r2.Point) r2.Point
+	if gyro != nil {
+		k := f.cfg.getIntrinsics(now.Bounds())
+		rvec := r3.Vector(*gyro).Mul(diff.Seconds())
+		derotate = func(p r2.Point) r2.Point {
+			return k.derotate(rvec, p)
+		}
+	}
+	var r flowResult
+	var err error
+	if f.cfg.Dense {
+		r, err = computeDenseFlow(key.image, now, diff, focal, derotate, f.cfg.denseParams(), f.logger)
+	} else {
+		r, err = computeFlow(key.image, now, diff, focal, derotate, tracker, tracks, f.logger)
+	}
+	if err != nil {
+		return r, err
+	}
+
+	if f.cfg.Downward {
+		r, err = f.groundVelocity(key, next, r, diff)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if gyro != nil {
+		visual := spatialmath.AngularVelocity{Z: gyro.Z + r.angular.Z}
+		r.angular = spatialmath.AngularVelocity{X: gyro.X, Y: gyro.Y, Z: fuseAngular(visual, *gyro, f.cfg.getIMUWeight()).Z}
+	}
+	return r, nil
+}
+
+// groundVelocity turns the flow of features on the ground into the camera's velocity in meters per second.
+// The ground moves the opposite way from the camera, by focal length pixels for every meter away it is.
+// The height at next is kept for telling how fast the ground is getting closer once it is the keyframe.
+func (f *flow) groundVelocity(key keyframe, next *keyframe, r flowResult, diff time.Duration) (flowResult, error) {
+	height, measured, err := f.groundDistance()
+	if err != nil {
+		return r, err
+	}
+
+	// x and y are how the ground moves, the camera goes the other way, but z is already the camera's
+	r.linear = r3.Vector{X: -r.linear.X, Y: -r.linear.Y, Z: r.linear.Z}.Mul(height)
+	r.linearPerPixel *= height
+	if measured && key.height > 0 {
+		// z points at the ground, so getting closer is positive
+		r.linear.Z = (key.height - height) / diff.Seconds()
+	}
+	if measured {
+		next.height = height
+	}
+	return r, nil
+}
+
+// groundDistance returns meters to the ground from the rangefinder, true if it was measured,
+// or height-meters if there is no rangefinder or it failed
+func (f *flow) groundDistance() (float64, bool, error) {
+	if f.rangefinder != nil {
+		d, err := f.readRangefinder()
+		if err == nil {
+			return d, true, nil
+		}
+		if f.cfg.HeightMeters <= 0 {
+			return 0, false, err
+		}
+		f.logger.Warnf("%v, using height-meters", err)
+	}
+	return f.cfg.HeightMeters, false, nil
+}
+
+func (f *flow) readRangefinder() (float64, error) {
+	readings, err := f.rangefinder.Readings(f.cancelCtx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read rangefinder %s: %w", f.cfg.Rangefinder, err)
+	}
+	d, ok := readings["distance"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("rangefinder %s has no distance reading, got %v", f.cfg.Rangefinder, readings)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("rangefinder %s gave a bad distance %v", f.cfg.Rangefinder, d)
+	}
+	return d, nil
+}
+
 func (f *flow) run() {
-	state := loopState{}
+	state := loopState{tracks: &featureTracker{}}
 	for f.cancelCtx.Err() == nil {
 		start := time.Now()
-		f.lastError = f.doLoop(&state)
-		if f.lastError != nil {
-			f.lastUpdate = time.Now()
+		err := f.doLoop(&state)
+
+		f.dataLock.Lock()
+		period := f.params.period
+		newFrame := !errors.Is(err, errNoNewFrame)
+		if newFrame {
+			f.lastError = err
+			if f.lastError != nil {
+				f.lastUpdate = time.Now()
+			}
+		}
+		f.dataLock.Unlock()
+
+		if !newFrame {
+			// check again within a quarter of a period, but never so often as to keep the camera busy
+			f.wait(max(period/4, 10*time.Millisecond))
+			continue
 		}
-		time.Sleep((500 * time.Millisecond) - time.Since(start))
+
+		// as fast as frames come, up to rate-hz, and if processing takes longer the frames in between are dropped
+		f.wait(period - time.Since(start))
+	}
+}
+
+// wait sleeps for d, returning early when closed
+func (f *flow) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-f.cancelCtx.Done():
+	case <-time.After(d):
 	}
 }
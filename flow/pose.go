@@ -0,0 +1,89 @@
+package flow
+
+import (
+	"math"
+
+	"github.com/golang/geo/r3"
+	geo "github.com/kellydunn/golang-geo"
+
+	"go.viam.com/rdk/spatialmath"
+)
+
+// orientationFromVector turns axis times angle in radians into an orientation
+func orientationFromVector(v r3.Vector) spatialmath.Orientation {
+	if v.Norm() < 1e-12 {
+		return spatialmath.NewZeroOrientation()
+	}
+	return spatialmath.R3ToR4(v)
+}
+
+// deadReckoning integrates velocities in the base frame into a pose relative to where it started,
+// and places that on the globe using an origin and the heading the base faced at the start
+type deadReckoning struct {
+	pose spatialmath.Pose // in meters, in the base frame at the start (x right, y forward, z up)
+
+	origin   *geo.Point
+	altitude float64 // meters
+	heading  float64 // degrees clockwise from north of the base's forward axis at the start
+}
+
+func newDeadReckoning(origin *geo.Point, altitude, heading float64) *deadReckoning {
+	return &deadReckoning{
+		pose:     spatialmath.NewZeroPose(),
+		origin:   origin,
+		altitude: altitude,
+		heading:  heading,
+	}
+}
+
+// update moves the pose by the given velocities over dt seconds
+func (d *deadReckoning) update(linear r3.Vector, angular spatialmath.AngularVelocity, dt float64) {
+	step := spatialmath.NewPose(linear.Mul(dt), orientationFromVector(r3.Vector(angular).Mul(dt)))
+	d.pose = spatialmath.Compose(d.pose, step)
+}
+
+// position returns where the pose is on the globe and its altitude in meters
+func (d *deadReckoning) position() (*geo.Point, float64) {
+	p := d.pose.Point()
+
+	sin, cos := math.Sincos(d.heading * math.Pi / 180)
+	east := p.Y*sin + p.X*cos
+	north := p.Y*cos - p.X*sin
+
+	distanceKm := math.Hypot(east, north) / 1000
+	bearing := math.Atan2(east, north) * 180 / math.Pi
+	return d.origin.PointAtDistanceAndBearing(distanceKm, bearing), d.altitude + p.Z
+}
+
+// yawRate returns how fast the base turns about the vertical, in degrees per second clockwise seen from above,
+// given its angular velocity in the base frame
+func yawRate(angular spatialmath.AngularVelocity) float64 {
+	// z is up, so turning counterclockwise about it is positive
+	return -angular.Z * 180 / math.Pi
+}
+
+// toDegrees turns angular velocity in radians per second, which everything is worked out in, into degrees per
+// second, which is what movement sensors report, like the imu
+func toDegrees(angular spatialmath.AngularVelocity) spatialmath.AngularVelocity {
+	return spatialmath.AngularVelocity(r3.Vector(angular).Mul(180 / math.Pi))
+}
+
+// flowYawRate is yawRate for features moving across the view of a forward camera at linear, turning right
+// when they move left
+func flowYawRate(linear r3.Vector) float64 {
+	return -linear.X * 180 / math.Pi
+}
+
+// extrinsics is how the camera is mounted on the base
+type extrinsics struct {
+	rvec  r3.Vector // rotation vector from the camera frame to the base frame
+	lever r3.Vector // where the camera is in the base frame, in meters
+}
+
+// toBase turns the camera's velocities in its own frame into the base's in the base frame.
+// A camera away from the center also moves when the base turns in place, that's taken out.
+func (e extrinsics) toBase(linear r3.Vector, angular spatialmath.AngularVelocity) (r3.Vector, spatialmath.AngularVelocity) {
+	w := rotate(e.rvec, r3.Vector(angular))
+	v := rotate(e.rvec, linear).Sub(w.Cross(e.lever))
+	return v, spatialmath.AngularVelocity(w)
+}
@@ -0,0 +1,49 @@
+package flow
+
+import (
+	"math/rand"
+)
+
+// ransac finds the model with the most inliers among n samples.
+// fit builds a model from the samples at the given indexes, and residual scores one sample against a model.
+// It returns the inlier mask of the best model, or nil if no model could be fit.
+func ransac[M any](n, sampleSize, iterations int, threshold float64, fit func(idx []int) (M, bool), residual func(m M, i int) float64) []bool {
+	if n < sampleSize {
+		return nil
+	}
+
+	// fixed seed so the same frames always give the same answer
+	rng := rand.New(rand.NewSource(1))
+
+	var best []bool
+	bestCount := 0
+	for it := 0; it < iterations; it++ {
+		m, ok := fit(rng.Perm(n)[:sampleSize])
+		if !ok {
+			continue
+		}
+
+		inliers := make([]bool, n)
+		count := 0
+		for i := 0; i < n; i++ {
+			if residual(m, i) <= threshold {
+				inliers[i] = true
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = inliers, count
+		}
+	}
+	return best
+}
+
+func countTrue(mask []bool) int {
+	n := 0
+	for _, b := range mask {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package flow
+
+import (
+	"hash/fnv"
+	"image"
+	"math"
+	"time"
+)
+
+// frameStats keeps track of how fast frames are processed, and how many the camera captured
+// that were never processed because the last one was still being worked on
+type frameStats struct {
+	lastCaptured  time.Time
+	lastProcessed time.Time
+
+	frameInterval time.Duration // shortest time seen between frames, how fast the camera goes
+	rate          float64       // frames processed per second, smoothed
+	dropped       int
+}
+
+// add records that the frame captured at captured was processed at processed.
+// Gaps longer than stale are the camera stopping, not frames being dropped.
+func (s *frameStats) add(captured, processed time.Time, stale time.Duration) {
+	defer func() {
+		s.lastCaptured = captured
+		s.lastProcessed = processed
+	}()
+	if s.lastCaptured.IsZero() {
+		return
+	}
+
+	gap := captured.Sub(s.lastCaptured)
+	if gap <= 0 || gap > stale {
+		return
+	}
+	if s.frameInterval == 0 || gap < s.frameInterval {
+		s.frameInterval = gap
+	}
+	s.dropped += max(int(math.Round(float64(gap)/float64(s.frameInterval)))-1, 0)
+
+	if interval := processed.Sub(s.lastProcessed).Seconds(); interval > 0 {
+		if s.rate == 0 {
+			s.rate = 1 / interval
+		} else {
+			s.rate = 0.8*s.rate + 0.2/interval
+		}
+	}
+}
+
+// fingerprint hashes a grid of img's pixels, to tell a new frame from the same one again when the camera
+// doesn't say when it was captured. Sensor noise changes some of them from one frame to the next.
+func fingerprint(img image.Image) uint64 {
+	const samples = 64
+	b := img.Bounds()
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for j := 0; j < samples; j++ {
+		for i := 0; i < samples; i++ {
+			r, g, bl, _ := img.At(b.Min.X+b.Dx()*i/samples, b.Min.Y+b.Dy()*j/samples).RGBA()
+			buf[0], buf[1], buf[2], buf[3], buf[4], buf[5] = byte(r), byte(r>>8), byte(g), byte(g>>8), byte(bl), byte(bl>>8)
+			h.Write(buf[:6])
+		}
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,40 @@
+package flow
+
+import (
+	"github.com/golang/geo/r3"
+
+	"go.viam.com/rdk/spatialmath"
+)
+
+// gyroBiasWeight is how much of the imu's angular velocity goes into its bias each frame it is stationary
+const gyroBiasWeight = 0.1
+
+// stationaryDetector decides the camera isn't moving, once the features have moved less than pixels a frame,
+// and the imu if there is one has turned slower than turn, for frames frames in a row
+type stationaryDetector struct {
+	pixels float64
+	turn   float64 // radians per second
+	frames int
+
+	still int // frames in a row it has looked stationary
+}
+
+// update returns whether the camera is stationary, after a frame where the features moved pixels a frame and
+// the imu's angular velocity was gyro, nil without one
+func (s *stationaryDetector) update(pixels float64, gyro *spatialmath.AngularVelocity) bool {
+	if pixels < s.pixels && (gyro == nil || r3.Vector(*gyro).Norm() < s.turn) {
+		s.still++
+	} else {
+		s.still = 0
+	}
+	return s.stationary()
+}
+
+func (s *stationaryDetector) stationary() bool {
+	return s.still >= s.frames
+}
+
+// updateBias moves bias toward gyro, the imu's angular velocity while stationary, which is all bias
+func updateBias(bias r3.Vector, gyro spatialmath.AngularVelocity) r3.Vector {
+	return bias.Mul(1 - gyroBiasWeight).Add(r3.Vector(gyro).Mul(gyroBiasWeight))
+}
@@ -0,0 +1,260 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/geo/r2"
+	"github.com/golang/geo/r3"
+	"gocv.io/x/gocv"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/spatialmath"
+)
+
+// solvePnP flags from OpenCV, which gocv doesn't name
+const (
+	solvePnPIterative = 0
+	solvePnPEPnP      = 1
+)
+
+const (
+	stereoMaxEpipolarError = 1.5 // pixels a feature can drift vertically between the rectified left and right image
+	stereoMinDisparity     = .5  // pixels, anything less is too far away to triangulate
+
+	pnpSampleSize        = 6
+	pnpMinPoints         = 8
+	pnpRansacIterations  = 100
+	pnpReprojectionError = 2.0 // pixels
+)
+
+// intrinsics of a rectified pinhole camera, in pixels
+type intrinsics struct {
+	focal  float64
+	cx, cy float64
+}
+
+// unproject returns the point in the camera frame seen at pixel (x, y) at the given depth
+func (k intrinsics) unproject(x, y, z float64) r3.Vector {
+	return r3.Vector{X: (x - k.cx) * z / k.focal, Y: (y - k.cy) * z / k.focal, Z: z}
+}
+
+// normalize converts a pixel to normalized image coordinates, x and y at a depth of 1
+func (k intrinsics) normalize(p gocv.Point2f) r2.Point {
+	return r2.Point{X: (float64(p.X) - k.cx) / k.focal, Y: (float64(p.Y) - k.cy) / k.focal}
+}
+
+// project returns the pixel a point in the camera frame is seen at, false if it is behind the camera
+func (k intrinsics) project(p r3.Vector) (float64, float64, bool) {
+	if p.Z <= 0 {
+		return 0, 0, false
+	}
+	return k.focal*p.X/p.Z + k.cx, k.focal*p.Y/p.Z + k.cy, true
+}
+
+func (k intrinsics) cameraMatrix() gocv.Mat {
+	m := gocv.Eye(3, 3, gocv.MatTypeCV64F)
+	m.SetDoubleAt(0, 0, k.focal)
+	m.SetDoubleAt(1, 1, k.focal)
+	m.SetDoubleAt(0, 2, k.cx)
+	m.SetDoubleAt(1, 2, k.cy)
+	return m
+}
+
+// pnpModel is the motion taking points from the previous camera frame into the current one
+type pnpModel struct {
+	rvec r3.Vector // axis times angle in radians
+	tvec r3.Vector
+}
+
+func (m pnpModel) apply(p r3.Vector) r3.Vector {
+	return rotate(m.rvec, p).Add(m.tvec)
+}
+
+// solvePnP wraps gocv.SolvePnP, returning false if there was no solution
+func solvePnP(obj []gocv.Point3f, img []gocv.Point2f, cameraMatrix gocv.Mat, flags int) (pnpModel, bool) {
+	objVec := gocv.NewPoint3fVectorFromPoints(obj)
+	defer objVec.Close()
+	imgVec := gocv.NewPoint2fVectorFromPoints(img)
+	defer imgVec.Close()
+
+	distCoeffs := gocv.NewMat()
+	defer distCoeffs.Close()
+	rvec := gocv.NewMat()
+	defer rvec.Close()
+	tvec := gocv.NewMat()
+	defer tvec.Close()
+
+	if !gocv.SolvePnP(objVec, imgVec, cameraMatrix, distCoeffs, &rvec, &tvec, false, flags) || rvec.Empty() || tvec.Empty() {
+		return pnpModel{}, false
+	}
+
+	m := pnpModel{
+		rvec: r3.Vector{X: rvec.GetDoubleAt(0, 0), Y: rvec.GetDoubleAt(1, 0), Z: rvec.GetDoubleAt(2, 0)},
+		tvec: r3.Vector{X: tvec.GetDoubleAt(0, 0), Y: tvec.GetDoubleAt(1, 0), Z: tvec.GetDoubleAt(2, 0)},
+	}
+	if math.IsNaN(m.rvec.Norm()) || math.IsNaN(m.tvec.Norm()) {
+		return pnpModel{}, false
+	}
+	return m, true
+}
+
+// reprojectionError is how many pixels from img the point obj is seen after moving it by m
+func (k intrinsics) reprojectionError(m pnpModel, obj gocv.Point3f, img gocv.Point2f) float64 {
+	u, v, ok := k.project(m.apply(r3.Vector{X: float64(obj.X), Y: float64(obj.Y), Z: float64(obj.Z)}))
+	if !ok {
+		return math.Inf(1)
+	}
+	return math.Hypot(u-float64(img.X), v-float64(img.Y))
+}
+
+// solvePnPRansac estimates the motion from 3D points in the previous camera frame to where they are seen now.
+// Minimal samples are solved with EPnP, and the result is refined on all inliers of the best one.
+func solvePnPRansac(obj []gocv.Point3f, img []gocv.Point2f, k intrinsics) (pnpModel, []bool, error) {
+	cameraMatrix := k.cameraMatrix()
+	defer cameraMatrix.Close()
+
+	residual := func(m pnpModel, i int) float64 {
+		return k.reprojectionError(m, obj[i], img[i])
+	}
+
+	inliers := ransac(len(obj), pnpSampleSize, pnpRansacIterations, pnpReprojectionError,
+		func(idx []int) (pnpModel, bool) {
+			o := make([]gocv.Point3f, len(idx))
+			p := make([]gocv.Point2f, len(idx))
+			for i, j := range idx {
+				o[i], p[i] = obj[j], img[j]
+			}
+			return solvePnP(o, p, cameraMatrix, solvePnPEPnP)
+		},
+		residual,
+	)
+
+	o := []gocv.Point3f{}
+	p := []gocv.Point2f{}
+	for i, in := range inliers {
+		if in {
+			o = append(o, obj[i])
+			p = append(p, img[i])
+		}
+	}
+	if len(o) < pnpMinPoints {
+		return pnpModel{}, nil, fmt.Errorf("only %d of %d points agree on a motion", len(o), len(obj))
+	}
+
+	m, ok := solvePnP(o, p, cameraMatrix, solvePnPIterative)
+	if !ok {
+		return pnpModel{}, nil, errors.New("cannot refine motion on inliers")
+	}
+	return m, inliers, nil
+}
+
+// computeStereoFlow calculates metric linear and angular velocity of the left camera.
+// Features in the previous left frame are triangulated against the previous right frame,
+// tracked into the current left frame, and the motion between frames comes from PnP with RANSAC.
+// Returns:
+// - linear velocity as r3.Vector in meters per second in the left camera frame (x right, y down, z forward)
+// - angular velocity in radians per second in the same frame
+// - how many features were triangulated and tracked, and how many of them were inliers
+// - error if there weren't enough features to get a reliable answer
+func computeStereoFlow(prevLeft, prevRight, nowLeft image.Image, timeBetween time.Duration, k intrinsics, baseline float64,
+	params trackerParams, tracks *featureTracker, logger logging.Logger) (flowResult, error) {
+	dt := timeBetween.Seconds()
+	if dt <= 0 {
+		return flowResult{}, errors.New("time between frames must be positive")
+	}
+
+	prevLeftGray, err := toGray(prevLeft)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer prevLeftGray.Close()
+
+	prevRightGray, err := toGray(prevRight)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer prevRightGray.Close()
+
+	nowLeftGray, err := toGray(nowLeft)
+	if err != nil {
+		return flowResult{}, err
+	}
+	defer nowLeftGray.Close()
+
+	features := tracks.features(prevLeftGray, params)
+	rightPts, rightOk, _ := trackPoints(prevLeftGray, prevRightGray, features, params)
+	nowPts, nowOk, nowErrs := trackPoints(prevLeftGray, nowLeftGray, features, params)
+
+	// only tracks that were inliers are followed into the next frame
+	keep := make([]bool, len(features))
+	defer tracks.update(nowPts, keep)
+
+	obj := []gocv.Point3f{}
+	img := []gocv.Point2f{}
+	errs := []float64{}
+	objIdx := []int{}
+	for i, pt := range features {
+		if !rightOk[i] || !nowOk[i] {
+			continue
+		}
+
+		disparity := float64(pt.X - rightPts[i].X)
+		if math.Abs(float64(pt.Y-rightPts[i].Y)) > stereoMaxEpipolarError || disparity < stereoMinDisparity {
+			continue
+		}
+
+		p := k.unproject(float64(pt.X), float64(pt.Y), baseline*k.focal/disparity)
+		obj = append(obj, gocv.Point3f{X: float32(p.X), Y: float32(p.Y), Z: float32(p.Z)})
+		img = append(img, nowPts[i])
+		errs = append(errs, nowErrs[i])
+		objIdx = append(objIdx, i)
+	}
+
+	logger.Debugf("stereo features: %d detected, %d triangulated and tracked", len(features), len(obj))
+
+	if len(obj) < pnpMinPoints {
+		return flowResult{}, fmt.Errorf("only %d features could be triangulated and tracked", len(obj))
+	}
+
+	m, inliers, err := solvePnPRansac(obj, img, k)
+	if err != nil {
+		return flowResult{}, err
+	}
+
+	// m moves points into the new camera frame, the camera itself moved by the inverse of that
+	moved := rotate(m.rvec.Mul(-1), m.tvec).Mul(-1)
+	spin := m.rvec.Mul(-1 / dt)
+
+	reprojection := []float64{}
+	inlierErrs := []float64{}
+	depths := []float64{}
+	for i, in := range inliers {
+		keep[objIdx[i]] = in
+		if in {
+			reprojection = append(reprojection, k.reprojectionError(m, obj[i], img[i]))
+			inlierErrs = append(inlierErrs, errs[i])
+			depths = append(depths, float64(obj[i].Z))
+		}
+	}
+	sort.Float64s(depths)
+
+	vectors := flowVectors(features, nowPts, objIdx, inliers)
+	return flowResult{
+		linear:     moved.Mul(1 / dt),
+		angular:    spatialmath.AngularVelocity{X: spin.X, Y: spin.Y, Z: spin.Z},
+		tracked:    len(obj),
+		inliers:    countTrue(inliers),
+		residual:   rms(reprojection),
+		trackError: mean(inlierErrs),
+		vectors:    vectors,
+		pixels:     medianMotion(vectors),
+		// a pixel is further the deeper the features are
+		linearPerPixel:  depths[len(depths)/2] / k.focal,
+		angularPerPixel: 1 / k.focal,
+	}, nil
+}
@@ -0,0 +1,148 @@
+package flow
+
+import (
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// track is a feature followed across frames
+type track struct {
+	pt  gocv.Point2f // where it was last seen
+	age int          // frames it has been followed for
+}
+
+// featureTracker follows features from frame to frame instead of finding new ones every time,
+// which is cheaper and drifts less. A nil featureTracker finds new features every frame.
+type featureTracker struct {
+	tracks []track
+}
+
+// features returns where to start tracking from in gray, the frame the tracks were last seen in.
+// If fewer than minTracks are left, new features are found spread over a grid of the frame,
+// away from the ones still being followed.
+func (ft *featureTracker) features(gray gocv.Mat, p trackerParams) []gocv.Point2f {
+	if ft == nil {
+		return detectFeatures(gray, p)
+	}
+
+	if len(ft.tracks) < p.minTracks {
+		existing := ft.points()
+		for _, pt := range detectFeaturesGrid(gray, p, existing) {
+			ft.tracks = append(ft.tracks, track{pt: pt})
+		}
+	}
+	return ft.points()
+}
+
+func (ft *featureTracker) points() []gocv.Point2f {
+	pts := make([]gocv.Point2f, len(ft.tracks))
+	for i, t := range ft.tracks {
+		pts[i] = t.pt
+	}
+	return pts
+}
+
+// update moves the tracks from features to where they are in the new frame, dropping the ones not kept
+func (ft *featureTracker) update(next []gocv.Point2f, keep []bool) {
+	if ft == nil {
+		return
+	}
+	kept := ft.tracks[:0]
+	for i, t := range ft.tracks {
+		if i < len(keep) && keep[i] {
+			kept = append(kept, track{pt: next[i], age: t.age + 1})
+		}
+	}
+	ft.tracks = kept
+}
+
+// clone returns a copy to track from the same frame without changing ft
+func (ft *featureTracker) clone() *featureTracker {
+	if ft == nil {
+		return nil
+	}
+	return &featureTracker{tracks: append([]track{}, ft.tracks...)}
+}
+
+// meanAge returns how many frames the tracks have been followed for on average
+func (ft *featureTracker) meanAge() float64 {
+	if ft == nil || len(ft.tracks) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, t := range ft.tracks {
+		sum += t.age
+	}
+	return float64(sum) / float64(len(ft.tracks))
+}
+
+// reset forgets all tracks, for when the next frame isn't a continuation of the last
+func (ft *featureTracker) reset() {
+	if ft != nil {
+		ft.tracks = nil
+	}
+}
+
+// gridCells splits bounds into size by size cells
+func gridCells(bounds image.Rectangle, size int) []image.Rectangle {
+	cells := []image.Rectangle{}
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			cells = append(cells, image.Rect(
+				bounds.Min.X+bounds.Dx()*i/size, bounds.Min.Y+bounds.Dy()*j/size,
+				bounds.Min.X+bounds.Dx()*(i+1)/size, bounds.Min.Y+bounds.Dy()*(j+1)/size,
+			))
+		}
+	}
+	return cells
+}
+
+// tooClose returns true if pt is within minDistance of any of pts
+func tooClose(pt gocv.Point2f, pts []gocv.Point2f, minDistance float64) bool {
+	for _, o := range pts {
+		if math.Hypot(float64(pt.X-o.X), float64(pt.Y-o.Y)) < minDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFeaturesGrid finds new features so that each cell of the grid has its share of maxCorners,
+// counting the existing ones, and none are within minDistance of an existing one
+func detectFeaturesGrid(gray gocv.Mat, p trackerParams, existing []gocv.Point2f) []gocv.Point2f {
+	size := max(p.gridSize, 1)
+	quota := (p.maxCorners + size*size - 1) / (size * size)
+
+	found := []gocv.Point2f{}
+	for _, cell := range gridCells(image.Rect(0, 0, gray.Cols(), gray.Rows()), size) {
+		if cell.Empty() {
+			continue
+		}
+		have := 0
+		for _, pt := range existing {
+			if image.Pt(int(pt.X), int(pt.Y)).In(cell) {
+				have++
+			}
+		}
+		if have >= quota {
+			continue
+		}
+
+		region := gray.Region(cell)
+		cp := p
+		cp.maxCorners = quota - have
+		pts := detectFeatures(region, cp)
+		region.Close()
+
+		for _, pt := range pts {
+			pt.X += float32(cell.Min.X)
+			pt.Y += float32(cell.Min.Y)
+			if !tooClose(pt, existing, p.minDistance) {
+				found = append(found, pt)
+			}
+		}
+	}
+	return found
+}
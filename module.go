@@ -4,6 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
 
 	"go.viam.com/rdk/components/camera"
 	"go.viam.com/rdk/logging"
@@ -24,15 +29,60 @@ func init() {
 	)
 }
 
+// BaselineCamera is one camera of a multi-camera bar
+type BaselineCamera struct {
+	Name string `json:"name"`
+
+	// BaselineMeters is the offset from the reference camera along the x axis (positive is to the right)
+	BaselineMeters float64 `json:"baseline-meters"`
+}
+
 type Config struct {
 	Left  string
 	Right string
 
+	// Cameras replaces Left and Right with any number of rectified cameras on one horizontal line.
+	// The first one is the reference camera, and all baselines are relative to it.
+	Cameras []BaselineCamera `json:"cameras"`
+
 	DistanceMeters    float64 `json:"distance-meters"`
 	FocalLengthPixels float64 `json:"focal-length-pixels"`
 
-	MinDisparity float64 `json:"max-disparity"`
-	MaxDisparity float64 `json:"min-disparity"`
+	MinDisparity float64 `json:"min-disparity"`
+	MaxDisparity float64 `json:"max-disparity"`
+
+	// MinDepthMeters and MaxDepthMeters set the disparity range from the depths we care about.
+	// They take precedence over min-disparity and max-disparity, which depend on the resolution.
+	MinDepthMeters float64 `json:"min-depth-meters"`
+	MaxDepthMeters float64 `json:"max-depth-meters"`
+
+	// CalibrationWidthPixels is the image width focal-length-pixels was measured at.
+	// If set, the focal length, and with it a depth based disparity range, scales with the actual width.
+	CalibrationWidthPixels int `json:"calibration-width-pixels"`
+
+	// ROI only matches pixels inside this rectangle of the reference image
+	ROI *image.Rectangle `json:"roi"`
+
+	// MaskPath is an image the size of the reference image, pixels that are black in it are not matched
+	MaskPath string `json:"mask-path"`
+
+	// CropBox drops points outside of it, in meters in the reference camera frame
+	CropBox *Box `json:"crop-box"`
+
+	// VoxelSizeMeters, if set, downsamples the cloud to one averaged point per voxel of this size
+	VoxelSizeMeters float64 `json:"voxel-size-meters"`
+
+	// MaxPoints, if set, caps the number of points after downsampling, keeping the densest voxels
+	MaxPoints int `json:"max-points"`
+
+	// StatisticalOutlierK, if set, removes points whose mean distance to their k nearest neighbors
+	// is more than StatisticalOutlierStdDevs standard deviations above the average
+	StatisticalOutlierK       int     `json:"statistical-outlier-k"`
+	StatisticalOutlierStdDevs float64 `json:"statistical-outlier-std-devs"`
+
+	// RadiusOutlierMeters, if set, removes points with fewer than RadiusOutlierMinNeighbors other points within it
+	RadiusOutlierMeters       float64 `json:"radius-outlier-meters"`
+	RadiusOutlierMinNeighbors int     `json:"radius-outlier-min-neighbors"`
 
 	// DisparityStep controls how many pixels to skip when comparing (higher = faster but less dense)
 	DisparityStep int
@@ -41,20 +91,68 @@ type Config struct {
 	PixelStep int
 }
 
-func (cfg *Config) getMinDisparity() float64 {
+// getFocalLength returns the focal length in pixels for images of the given width
+func (cfg *Config) getFocalLength(width int) float64 {
+	if cfg.CalibrationWidthPixels <= 0 || width <= 0 {
+		return cfg.FocalLengthPixels
+	}
+	return cfg.FocalLengthPixels * float64(width) / float64(cfg.CalibrationWidthPixels)
+}
+
+func (cfg *Config) getMinDisparity(focalLength float64) float64 {
+	if cfg.MaxDepthMeters > 0 {
+		return cfg.getBaseline() * focalLength / cfg.MaxDepthMeters
+	}
 	if cfg.MinDisparity <= 0 {
 		return 1
 	}
 	return cfg.MinDisparity
 }
 
-func (cfg *Config) getMaxDisparity() float64 {
+func (cfg *Config) getMaxDisparity(focalLength float64) float64 {
+	if cfg.MinDepthMeters > 0 {
+		return math.Ceil(cfg.getBaseline() * focalLength / cfg.MinDepthMeters)
+	}
 	if cfg.MaxDisparity <= 0 {
 		return 64
 	}
 	return cfg.MaxDisparity
 }
 
+// getCameras returns the reference camera first, followed by the ones to match against
+func (cfg *Config) getCameras() []BaselineCamera {
+	if len(cfg.Cameras) > 0 {
+		return cfg.Cameras
+	}
+	return []BaselineCamera{
+		{Name: cfg.Left},
+		{Name: cfg.Right, BaselineMeters: cfg.DistanceMeters},
+	}
+}
+
+// getBaseline is the baseline that disparities are expressed in, the longest one we have
+func (cfg *Config) getBaseline() float64 {
+	baseline := 0.0
+	for _, c := range cfg.getCameras()[1:] {
+		baseline = math.Max(baseline, math.Abs(c.BaselineMeters))
+	}
+	return baseline
+}
+
+func (cfg *Config) getStatisticalOutlierStdDevs() float64 {
+	if cfg.StatisticalOutlierStdDevs <= 0 {
+		return 1
+	}
+	return cfg.StatisticalOutlierStdDevs
+}
+
+func (cfg *Config) getRadiusOutlierMinNeighbors() int {
+	if cfg.RadiusOutlierMinNeighbors <= 0 {
+		return 2
+	}
+	return cfg.RadiusOutlierMinNeighbors
+}
+
 func (cfg *Config) getDisparityStep() int {
 	return 1
 }
@@ -64,22 +162,84 @@ func (cfg *Config) getPixelStep() int {
 }
 
 func (cfg *Config) Validate(path string) ([]string, error) {
-	if cfg.Left == "" {
-		return nil, fmt.Errorf("need left")
+	if len(cfg.Cameras) > 0 {
+		if cfg.Left != "" || cfg.Right != "" || cfg.DistanceMeters != 0 {
+			return nil, fmt.Errorf("cameras replaces left, right and distance-meters, set one or the other")
+		}
+		if len(cfg.Cameras) < 2 {
+			return nil, fmt.Errorf("need at least 2 cameras")
+		}
+		for i, c := range cfg.Cameras {
+			if c.Name == "" {
+				return nil, fmt.Errorf("need name for camera %d", i)
+			}
+			if i == 0 && c.BaselineMeters != 0 {
+				return nil, fmt.Errorf("reference camera %s needs a baseline-meters of 0", c.Name)
+			}
+			if i > 0 && c.BaselineMeters == 0 {
+				return nil, fmt.Errorf("need baseline-meters for camera %s", c.Name)
+			}
+		}
+	} else {
+		if cfg.Left == "" {
+			return nil, fmt.Errorf("need left")
+		}
+		if cfg.Right == "" {
+			return nil, fmt.Errorf("need right")
+		}
+
+		if cfg.DistanceMeters <= 0 {
+			return nil, fmt.Errorf("need distance-meters")
+		}
 	}
-	if cfg.Right == "" {
-		return nil, fmt.Errorf("need right")
+
+	if cfg.FocalLengthPixels <= 0 {
+		return nil, fmt.Errorf("need focal-length-pixels")
 	}
 
-	if cfg.DistanceMeters <= 0 {
-		return nil, fmt.Errorf("need distance-meters")
+	if cfg.ROI != nil && cfg.ROI.Empty() {
+		return nil, fmt.Errorf("roi %v is empty", *cfg.ROI)
 	}
 
-	if cfg.FocalLengthPixels <= 0 {
-		return nil, fmt.Errorf("need focal-length-pixels")
+	if cfg.CropBox != nil {
+		if cfg.CropBox.Min.X > cfg.CropBox.Max.X || cfg.CropBox.Min.Y > cfg.CropBox.Max.Y || cfg.CropBox.Min.Z > cfg.CropBox.Max.Z {
+			return nil, fmt.Errorf("crop-box min %v has to be less than max %v", cfg.CropBox.Min, cfg.CropBox.Max)
+		}
+	}
+
+	if cfg.VoxelSizeMeters < 0 {
+		return nil, fmt.Errorf("voxel-size-meters cannot be negative")
+	}
+	if cfg.MaxPoints < 0 {
+		return nil, fmt.Errorf("max-points cannot be negative")
+	}
+	if cfg.MaxPoints > 0 && cfg.VoxelSizeMeters <= 0 {
+		return nil, fmt.Errorf("max-points needs voxel-size-meters")
+	}
+
+	if cfg.StatisticalOutlierK < 0 || cfg.StatisticalOutlierStdDevs < 0 {
+		return nil, fmt.Errorf("statistical-outlier-k and statistical-outlier-std-devs cannot be negative")
+	}
+	if cfg.RadiusOutlierMeters < 0 || cfg.RadiusOutlierMinNeighbors < 0 {
+		return nil, fmt.Errorf("radius-outlier-meters and radius-outlier-min-neighbors cannot be negative")
+	}
+
+	if cfg.MinDepthMeters < 0 || cfg.MaxDepthMeters < 0 {
+		return nil, fmt.Errorf("min-depth-meters and max-depth-meters cannot be negative")
+	}
+	if cfg.MinDepthMeters > 0 && cfg.MaxDepthMeters > 0 && cfg.MinDepthMeters >= cfg.MaxDepthMeters {
+		return nil, fmt.Errorf("min-depth-meters (%v) has to be less than max-depth-meters (%v)", cfg.MinDepthMeters, cfg.MaxDepthMeters)
+	}
+	// with only one depth set, the other end of the range is still a disparity
+	if minD, maxD := cfg.getMinDisparity(cfg.FocalLengthPixels), cfg.getMaxDisparity(cfg.FocalLengthPixels); minD >= maxD {
+		return nil, fmt.Errorf("min disparity (%v) has to be less than max disparity (%v), check the depths and disparities", minD, maxD)
 	}
 
-	return []string{cfg.Left, cfg.Right}, nil
+	deps := []string{}
+	for _, c := range cfg.getCameras() {
+		deps = append(deps, c.Name)
+	}
+	return deps, nil
 }
 
 type viamStereoCameraStereoCamera struct {
@@ -93,7 +253,10 @@ type viamStereoCameraStereoCamera struct {
 	cancelCtx  context.Context
 	cancelFunc func()
 
-	left, right camera.Camera
+	// cameras[0] is the reference camera, matching cfg.getCameras()
+	cameras []camera.Camera
+
+	mask image.Image
 }
 
 func newViamStereoCameraStereoCamera(ctx context.Context, deps resource.Dependencies, rawConf resource.Config, logger logging.Logger) (camera.Camera, error) {
@@ -118,27 +281,101 @@ func NewStereoCamera(ctx context.Context, deps resource.Dependencies, name resou
 		cancelFunc: cancelFunc,
 	}
 
-	var err error
-	s.left, err = camera.FromDependencies(deps, conf.Left)
-	if err != nil {
-		return nil, err
+	for _, c := range conf.getCameras() {
+		cam, err := camera.FromDependencies(deps, c.Name)
+		if err != nil {
+			return nil, err
+		}
+		s.cameras = append(s.cameras, cam)
 	}
-	s.right, err = camera.FromDependencies(deps, conf.Right)
+
+	if conf.MaskPath != "" {
+		var err error
+		s.mask, err = readImage(conf.MaskPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read mask-path: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func readImage(fn string) (image.Image, error) {
+	file, err := os.Open(fn)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	return s, nil
+	img, _, err := image.Decode(file)
+	return img, err
 }
 
 func (s *viamStereoCameraStereoCamera) Name() resource.Name {
 	return s.name
 }
 
+// defaultResolutionDistances are the depths depth_resolution reports on if none are given
+var defaultResolutionDistances = []float64{.5, 1, 2, 5, 10}
+
 func (s *viamStereoCameraStereoCamera) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := cmd["depth_resolution"]; ok {
+		return s.depthResolution(ctx, cmd)
+	}
 	return nil, nil
 }
 
+// depthResolution reports the disparity range in use and how far apart neighboring disparities are at several depths
+func (s *viamStereoCameraStereoCamera) depthResolution(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	distances := defaultResolutionDistances
+	if raw, ok := cmd["distances"].([]interface{}); ok {
+		distances = []float64{}
+		for _, d := range raw {
+			f, ok := d.(float64)
+			if !ok || f <= 0 {
+				return nil, fmt.Errorf("distances have to be positive numbers, got %v", d)
+			}
+			distances = append(distances, f)
+		}
+	}
+
+	width := 0
+	if s.cfg.CalibrationWidthPixels > 0 {
+		all, _, err := s.cameras[0].Images(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) == 0 {
+			return nil, fmt.Errorf("no images")
+		}
+		width = all[0].Image.Bounds().Dx()
+	}
+
+	c := s.stereoConfig(width)
+	bf := c.Baseline * c.FocalLength
+
+	resolution := []interface{}{}
+	for _, z := range distances {
+		d := bf / z
+		resolution = append(resolution, map[string]interface{}{
+			"distance_meters":   z,
+			"disparity_pixels":  d,
+			"resolution_meters": z * z * float64(c.DisparityStep) / bf,
+			"in_range":          d > c.MinDisparity && d < c.MaxDisparity,
+		})
+	}
+
+	return map[string]interface{}{
+		"focal_length_pixels": c.FocalLength,
+		"baseline_meters":     c.Baseline,
+		"min_disparity":       c.MinDisparity,
+		"max_disparity":       c.MaxDisparity,
+		"min_depth_meters":    bf / c.MaxDisparity,
+		"max_depth_meters":    bf / c.MinDisparity,
+		"resolution":          resolution,
+	}, nil
+}
+
 func (s *viamStereoCameraStereoCamera) Close(context.Context) error {
 	// Put close code here
 	s.cancelFunc()
@@ -146,45 +383,100 @@ func (s *viamStereoCameraStereoCamera) Close(context.Context) error {
 }
 
 func (s *viamStereoCameraStereoCamera) Image(ctx context.Context, mimeType string, extra map[string]interface{}) ([]byte, camera.ImageMetadata, error) {
-	return s.left.Image(ctx, mimeType, extra)
+	return s.cameras[0].Image(ctx, mimeType, extra)
 }
 
 func (s *viamStereoCameraStereoCamera) Images(ctx context.Context) ([]camera.NamedImage, resource.ResponseMetadata, error) {
-	return s.left.Images(ctx)
+	return s.cameras[0].Images(ctx)
+}
+
+// stereoConfig builds the matching config for images of the given width
+func (s *viamStereoCameraStereoCamera) stereoConfig(width int) StereoPCDConfig {
+	focalLength := s.cfg.getFocalLength(width)
+	c := StereoPCDConfig{
+		Baseline:    s.cfg.getBaseline(),
+		FocalLength: focalLength,
+
+		MinDisparity: s.cfg.getMinDisparity(focalLength),
+		MaxDisparity: s.cfg.getMaxDisparity(focalLength),
+
+		DisparityStep: s.cfg.getDisparityStep(),
+		PixelStep:     s.cfg.getPixelStep(),
+
+		Mask:    s.mask,
+		CropBox: s.cfg.CropBox,
+	}
+	if s.cfg.ROI != nil {
+		c.ROI = *s.cfg.ROI
+	}
+	return c
 }
 
 func (s *viamStereoCameraStereoCamera) NextPointCloud(ctx context.Context) (pointcloud.PointCloud, error) {
 	// TODO:  parallelize image loading
 
-	leftAll, _, err := s.left.Images(ctx)
-	if err != nil {
-		return nil, err
+	imgs := []image.Image{}
+	for i, cam := range s.cameras {
+		all, _, err := cam.Images(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) != 1 {
+			return nil, fmt.Errorf("why is camera %d returning %d images", i, len(all))
+		}
+		imgs = append(imgs, all[0].Image)
 	}
 
-	rightAll, _, err := s.right.Images(ctx)
+	c := s.stereoConfig(imgs[0].Bounds().Dx())
+
+	pc, err := s.match(imgs, c)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(leftAll) != 1 {
-		return nil, fmt.Errorf("why is leftAll %d", len(leftAll))
+	return s.filter(pc)
+}
+
+// match turns the images of all cameras into a cloud, using the simple pair matcher when there are only 2
+func (s *viamStereoCameraStereoCamera) match(imgs []image.Image, c StereoPCDConfig) (pointcloud.PointCloud, error) {
+	cams := s.cfg.getCameras()
+	if len(cams) == 2 && cams[1].BaselineMeters > 0 {
+		return StereoToPointCloud(imgs[0], imgs[1], c)
 	}
 
-	if len(rightAll) != 1 {
-		return nil, fmt.Errorf("why is rightAll %d", len(rightAll))
+	others := []BaselineImage{}
+	for i, img := range imgs[1:] {
+		others = append(others, BaselineImage{Image: img, Baseline: cams[i+1].BaselineMeters})
 	}
+	return MultiBaselineStereoToPointCloud(imgs[0], others, c)
+}
 
-	c := StereoPCDConfig{
-		Baseline:    s.cfg.DistanceMeters,
-		FocalLength: s.cfg.FocalLengthPixels,
+// filter runs the configured post processing on a matched cloud.
+// Downsampling goes first so the outlier filters have fewer points to look at.
+func (s *viamStereoCameraStereoCamera) filter(pc pointcloud.PointCloud) (pointcloud.PointCloud, error) {
+	var err error
+	if s.cfg.VoxelSizeMeters > 0 {
+		pc, err = VoxelDownsample(pc, s.cfg.VoxelSizeMeters, s.cfg.MaxPoints)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		MinDisparity: s.cfg.getMinDisparity(),
-		MaxDisparity: s.cfg.getMaxDisparity(),
+	if s.cfg.StatisticalOutlierK > 0 {
+		pc, err = StatisticalOutlierFilter(pc, s.cfg.StatisticalOutlierK, s.cfg.getStatisticalOutlierStdDevs())
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		DisparityStep: s.cfg.getDisparityStep(),
-		PixelStep:     s.cfg.getPixelStep(),
+	if s.cfg.RadiusOutlierMeters > 0 {
+		pc, err = RadiusOutlierFilter(pc, s.cfg.RadiusOutlierMeters, s.cfg.getRadiusOutlierMinNeighbors())
+		if err != nil {
+			return nil, err
+		}
 	}
-	return StereoToPointCloud(leftAll[0].Image, rightAll[0].Image, c)
+
+	return pc, nil
 }
 
 func (s *viamStereoCameraStereoCamera) Properties(ctx context.Context) (camera.Properties, error) {
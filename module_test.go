@@ -0,0 +1,90 @@
+package viamstereocamera
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+func TestDepthRange(t *testing.T) {
+	cfg := &Config{
+		Left:                   "l",
+		Right:                  "r",
+		DistanceMeters:         .1,
+		FocalLengthPixels:      500,
+		MinDepthMeters:         .5,
+		MaxDepthMeters:         10,
+		CalibrationWidthPixels: 640,
+	}
+	_, err := cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	f := cfg.getFocalLength(640)
+	test.That(t, f, test.ShouldAlmostEqual, 500)
+	test.That(t, cfg.getMinDisparity(f), test.ShouldAlmostEqual, 5)
+	test.That(t, cfg.getMaxDisparity(f), test.ShouldAlmostEqual, 100)
+
+	// half the resolution, half the disparities
+	f = cfg.getFocalLength(320)
+	test.That(t, f, test.ShouldAlmostEqual, 250)
+	test.That(t, cfg.getMinDisparity(f), test.ShouldAlmostEqual, 2.5)
+	test.That(t, cfg.getMaxDisparity(f), test.ShouldAlmostEqual, 50)
+
+	cfg.MinDepthMeters = 20
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// only a max depth, so the max disparity is the default 64
+	cfg.MinDepthMeters = 0
+	cfg.MaxDepthMeters = 2 // min disparity is 25
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	cfg.MaxDepthMeters = .5 // min disparity is 100
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+	cfg.MaxDepthMeters = 2
+	cfg.MaxDisparity = 20
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// only a min depth, so the min disparity is what's configured
+	cfg.MaxDepthMeters = 0
+	cfg.MaxDisparity = 0
+	cfg.MinDepthMeters = 1 // max disparity is 50
+	cfg.MinDisparity = 60
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+	cfg.MinDisparity = 10
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	// the json names match the fields
+	cfg = &Config{}
+	test.That(t, json.Unmarshal([]byte(`{"min-disparity": 2, "max-disparity": 80}`), cfg), test.ShouldBeNil)
+	test.That(t, cfg.MinDisparity, test.ShouldEqual, 2)
+	test.That(t, cfg.MaxDisparity, test.ShouldEqual, 80)
+}
+
+func TestValidateCameras(t *testing.T) {
+	cfg := &Config{
+		Cameras: []BaselineCamera{
+			{Name: "middle"},
+			{Name: "right", BaselineMeters: .1},
+		},
+		FocalLengthPixels: 500,
+	}
+	deps, err := cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deps, test.ShouldResemble, []string{"middle", "right"})
+
+	// half moved over to cameras, which would quietly use different cameras than left and right
+	cfg.Left = "left"
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+
+	cfg.Left = ""
+	cfg.DistanceMeters = .1
+	_, err = cfg.Validate("")
+	test.That(t, err, test.ShouldNotBeNil)
+}
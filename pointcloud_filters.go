@@ -0,0 +1,207 @@
+package viamstereocamera
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/golang/geo/r3"
+
+	"gonum.org/v1/gonum/spatial/kdtree"
+
+	"go.viam.com/rdk/pointcloud"
+)
+
+type voxelKey struct {
+	x, y, z int64
+}
+
+type voxelAccum struct {
+	key     voxelKey
+	sum     r3.Vector
+	r, g, b float64
+	colored int
+	count   int
+}
+
+// VoxelDownsample replaces all points in each voxelSize cube with one point at their average position and color.
+// If maxPoints > 0 and there are more voxels than that, the voxels holding the most points are kept.
+func VoxelDownsample(pc pointcloud.PointCloud, voxelSize float64, maxPoints int) (pointcloud.PointCloud, error) {
+	if voxelSize <= 0 {
+		return nil, fmt.Errorf("voxel size has to be positive, not %v", voxelSize)
+	}
+
+	voxels := map[voxelKey]*voxelAccum{}
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		k := voxelKey{
+			x: int64(math.Floor(p.X / voxelSize)),
+			y: int64(math.Floor(p.Y / voxelSize)),
+			z: int64(math.Floor(p.Z / voxelSize)),
+		}
+		v, ok := voxels[k]
+		if !ok {
+			v = &voxelAccum{key: k}
+			voxels[k] = v
+		}
+		v.sum = v.sum.Add(p)
+		v.count++
+		if d != nil && d.HasColor() {
+			r, g, b := d.RGB255()
+			v.r += float64(r)
+			v.g += float64(g)
+			v.b += float64(b)
+			v.colored++
+		}
+		return true
+	})
+
+	// sort so the output, and which voxels survive the cap, doesn't depend on map order
+	all := make([]*voxelAccum, 0, len(voxels))
+	for _, v := range voxels {
+		all = append(all, v)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].count != all[j].count {
+			return all[i].count > all[j].count
+		}
+		a, b := all[i].key, all[j].key
+		if a.x != b.x {
+			return a.x < b.x
+		}
+		if a.y != b.y {
+			return a.y < b.y
+		}
+		return a.z < b.z
+	})
+	if maxPoints > 0 && len(all) > maxPoints {
+		all = all[:maxPoints]
+	}
+
+	out := pointcloud.NewWithPrealloc(len(all))
+	for _, v := range all {
+		d := pointcloud.NewBasicData()
+		if v.colored > 0 {
+			n := float64(v.colored)
+			d = pointcloud.NewColoredData(color.NRGBA{
+				R: uint8(math.Round(v.r / n)),
+				G: uint8(math.Round(v.g / n)),
+				B: uint8(math.Round(v.b / n)),
+				A: 255,
+			})
+		}
+		err := out.Set(v.sum.Mul(1/float64(v.count)), d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// neighborIndex is a balanced kd tree over a cloud, which stays fast on the scan ordered points stereo produces
+type neighborIndex struct {
+	points []pointcloud.PointAndData
+	tree   *kdtree.Tree
+}
+
+func newNeighborIndex(pc pointcloud.PointCloud) *neighborIndex {
+	idx := &neighborIndex{}
+	pts := make(kdtree.Points, 0, pc.Size())
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		idx.points = append(idx.points, pointcloud.PointAndData{P: p, D: d})
+		pts = append(pts, kdtree.Point{p.X, p.Y, p.Z})
+		return true
+	})
+	idx.tree = kdtree.New(pts, false)
+	return idx
+}
+
+// keep returns a cloud of the points for which keep is true
+func (idx *neighborIndex) keep(keep []bool) (pointcloud.PointCloud, error) {
+	out := pointcloud.New()
+	for i, p := range idx.points {
+		if !keep[i] {
+			continue
+		}
+		err := out.Set(p.P, p.D)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// StatisticalOutlierFilter removes points whose mean distance to their k nearest neighbors is more
+// than stdDevs standard deviations above the mean of that distance over the whole cloud.
+func StatisticalOutlierFilter(pc pointcloud.PointCloud, k int, stdDevs float64) (pointcloud.PointCloud, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k has to be positive, not %d", k)
+	}
+	if pc.Size() <= k {
+		return pc, nil
+	}
+
+	idx := newNeighborIndex(pc)
+
+	meanDists := make([]float64, len(idx.points))
+	sum, sumSq := 0.0, 0.0
+	for i, p := range idx.points {
+		// the point itself comes back at distance 0, so ask for one more
+		keeper := kdtree.NewNKeeper(k + 1)
+		idx.tree.NearestSet(keeper, kdtree.Point{p.P.X, p.P.Y, p.P.Z})
+
+		total, n := 0.0, -1
+		for _, c := range keeper.Heap {
+			if c.Comparable == nil {
+				continue
+			}
+			// gonum distances are squared
+			total += math.Sqrt(c.Dist)
+			n++
+		}
+		if n > 0 {
+			meanDists[i] = total / float64(n)
+		}
+		sum += meanDists[i]
+		sumSq += meanDists[i] * meanDists[i]
+	}
+
+	count := float64(len(meanDists))
+	mean := sum / count
+	stdDev := math.Sqrt(math.Max(0, sumSq/count-mean*mean))
+	threshold := mean + stdDevs*stdDev
+
+	keep := make([]bool, len(meanDists))
+	for i, d := range meanDists {
+		keep[i] = d <= threshold
+	}
+	return idx.keep(keep)
+}
+
+// RadiusOutlierFilter removes points with fewer than minNeighbors other points within radius of them.
+func RadiusOutlierFilter(pc pointcloud.PointCloud, radius float64, minNeighbors int) (pointcloud.PointCloud, error) {
+	if radius <= 0 {
+		return nil, fmt.Errorf("radius has to be positive, not %v", radius)
+	}
+	if pc.Size() == 0 {
+		return pc, nil
+	}
+
+	idx := newNeighborIndex(pc)
+
+	keep := make([]bool, len(idx.points))
+	for i, p := range idx.points {
+		// gonum distances are squared
+		keeper := kdtree.NewDistKeeper(radius * radius)
+		idx.tree.NearestSet(keeper, kdtree.Point{p.P.X, p.P.Y, p.P.Z})
+
+		neighbors := -1 // the point itself
+		for _, c := range keeper.Heap {
+			if c.Comparable != nil {
+				neighbors++
+			}
+		}
+		keep[i] = neighbors >= minNeighbors
+	}
+	return idx.keep(keep)
+}
@@ -0,0 +1,80 @@
+package viamstereocamera
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/golang/geo/r3"
+	"go.viam.com/test"
+
+	"go.viam.com/rdk/pointcloud"
+)
+
+func TestVoxelDownsample(t *testing.T) {
+	pc := pointcloud.New()
+	test.That(t, pc.Set(r3.Vector{X: .01, Y: .01, Z: .01}, pointcloud.NewColoredData(color.NRGBA{R: 100, A: 255})), test.ShouldBeNil)
+	test.That(t, pc.Set(r3.Vector{X: .03, Y: .03, Z: .03}, pointcloud.NewColoredData(color.NRGBA{R: 200, A: 255})), test.ShouldBeNil)
+	test.That(t, pc.Set(r3.Vector{X: .02, Y: .04, Z: .09}, pointcloud.NewColoredData(color.NRGBA{R: 0, A: 255})), test.ShouldBeNil)
+	test.That(t, pc.Set(r3.Vector{X: 1.01, Y: .01, Z: .01}, pointcloud.NewColoredData(color.NRGBA{G: 50, A: 255})), test.ShouldBeNil)
+
+	out, err := VoxelDownsample(pc, .1, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Size(), test.ShouldEqual, 2)
+
+	out.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		r, g, _ := d.RGB255()
+		if p.X < .5 {
+			test.That(t, p.X, test.ShouldAlmostEqual, .02)
+			test.That(t, p.Y, test.ShouldAlmostEqual, .08/3)
+			test.That(t, p.Z, test.ShouldAlmostEqual, .13/3)
+			test.That(t, r, test.ShouldEqual, 100)
+		} else {
+			test.That(t, p.X, test.ShouldAlmostEqual, 1.01)
+			test.That(t, g, test.ShouldEqual, 50)
+		}
+		return true
+	})
+
+	// the cap keeps the densest voxel
+	out, err = VoxelDownsample(pc, .1, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Size(), test.ShouldEqual, 1)
+	_, ok := out.At(1.01, .01, .01)
+	test.That(t, ok, test.ShouldBeFalse)
+
+	_, err = VoxelDownsample(pc, 0, 0)
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+// gridWithFloater makes a dense 10x10 grid of points 1cm apart plus one point far away from it
+func gridWithFloater(t *testing.T) pointcloud.PointCloud {
+	pc := pointcloud.New()
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			test.That(t, pc.Set(r3.Vector{X: float64(x) * .01, Y: float64(y) * .01, Z: 1}, pointcloud.NewBasicData()), test.ShouldBeNil)
+		}
+	}
+	test.That(t, pc.Set(r3.Vector{X: .05, Y: .05, Z: .5}, pointcloud.NewBasicData()), test.ShouldBeNil)
+	return pc
+}
+
+func TestStatisticalOutlierFilter(t *testing.T) {
+	out, err := StatisticalOutlierFilter(gridWithFloater(t), 4, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Size(), test.ShouldEqual, 100)
+	_, ok := out.At(.05, .05, .5)
+	test.That(t, ok, test.ShouldBeFalse)
+}
+
+func TestRadiusOutlierFilter(t *testing.T) {
+	out, err := RadiusOutlierFilter(gridWithFloater(t), .015, 2)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Size(), test.ShouldEqual, 100)
+	_, ok := out.At(.05, .05, .5)
+	test.That(t, ok, test.ShouldBeFalse)
+
+	// corners only have 3 neighbors within 1.5cm
+	out, err = RadiusOutlierFilter(gridWithFloater(t), .015, 4)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out.Size(), test.ShouldEqual, 96)
+}
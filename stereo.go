@@ -21,6 +21,47 @@ type StereoPCDConfig struct {
 
 	DisparityStep int // controls how many pixels to skip when comparing (higher = faster but less dense)
 	PixelStep     int // controls how many pixels to skip in the image (higher = faster but less dense)
+
+	ROI     image.Rectangle // if not empty, only pixels inside it are matched
+	Mask    image.Image     // if set, pixels that are black in the mask are not matched
+	CropBox *Box            // if set, points outside of it are dropped
+}
+
+// Box is an axis aligned box in the reference camera frame, in meters
+type Box struct {
+	Min r3.Vector `json:"min"`
+	Max r3.Vector `json:"max"`
+}
+
+// Contains returns true if p is inside the box or on its faces
+func (b *Box) Contains(p r3.Vector) bool {
+	return p.X >= b.Min.X && p.X <= b.Max.X &&
+		p.Y >= b.Min.Y && p.Y <= b.Max.Y &&
+		p.Z >= b.Min.Z && p.Z <= b.Max.Z
+}
+
+// matchBounds returns the part of the image that should be matched
+func (config StereoPCDConfig) matchBounds(bounds image.Rectangle) (image.Rectangle, error) {
+	if config.Mask != nil {
+		maskBounds := config.Mask.Bounds()
+		if maskBounds.Dx() != bounds.Dx() || maskBounds.Dy() != bounds.Dy() {
+			return image.Rectangle{}, fmt.Errorf("mask is %v but images are %v", maskBounds.Size(), bounds.Size())
+		}
+	}
+	if config.ROI.Empty() {
+		return bounds, nil
+	}
+	return bounds.Intersect(config.ROI), nil
+}
+
+// masked returns true if the pixel should not be matched at all
+func (config StereoPCDConfig) masked(bounds image.Rectangle, x, y int) bool {
+	if config.Mask == nil {
+		return false
+	}
+	maskBounds := config.Mask.Bounds()
+	r, g, b, _ := config.Mask.At(x-bounds.Min.X+maskBounds.Min.X, y-bounds.Min.Y+maskBounds.Min.Y).RGBA()
+	return r == 0 && g == 0 && b == 0
 }
 
 func calculatePixelDifference(img1, img2 image.Image, x1, y1, x2, y2 int) float64 {
@@ -35,6 +76,30 @@ func calculatePixelDifference(img1, img2 image.Image, x1, y1, x2, y2 int) float6
 	return rDiff + gDiff + bDiff
 }
 
+// setPoint projects pixel (x, y) of img with the given disparity into pc
+func setPoint(pc pointcloud.PointCloud, img image.Image, x, y int, disparity, cx, cy float64, config StereoPCDConfig) error {
+	// Get the RGB color of the current pixel
+	r, g, b, _ := img.At(x, y).RGBA()
+	r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
+
+	// Calculate Z (depth) using the formula: Z = (baseline * focal_length) / disparity
+	z := (config.Baseline * config.FocalLength) / disparity
+
+	// Calculate X and Y using the pinhole camera model
+	x3d := ((float64(x) - cx) * z) / config.FocalLength
+	y3d := ((float64(y) - cy) * z) / config.FocalLength
+
+	p := r3.Vector{X: x3d, Y: y3d, Z: z}
+	if config.CropBox != nil && !config.CropBox.Contains(p) {
+		return nil
+	}
+
+	return pc.Set(
+		p,
+		pointcloud.NewColoredData(color.NRGBA{R: r8, G: g8, B: b8, A: 1}),
+	)
+}
+
 func StereoToPointCloud(leftImg, rightImg image.Image, config StereoPCDConfig) (pointcloud.PointCloud, error) {
 	bounds := leftImg.Bounds()
 	rightBounds := rightImg.Bounds()
@@ -48,15 +113,20 @@ func StereoToPointCloud(leftImg, rightImg image.Image, config StereoPCDConfig) (
 	cx := float64(bounds.Dx()) / 2.0
 	cy := float64(bounds.Dy()) / 2.0
 
+	matchBounds, err := config.matchBounds(bounds)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new point cloud
 	pc := pointcloud.New()
 
 	// For each pixel in the left image
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += config.PixelStep {
-		for x := bounds.Min.X; x < bounds.Max.X; x += config.PixelStep {
-			// Get the RGB color of the current pixel
-			r, g, b, _ := leftImg.At(x, y).RGBA()
-			r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
+	for y := matchBounds.Min.Y; y < matchBounds.Max.Y; y += config.PixelStep {
+		for x := matchBounds.Min.X; x < matchBounds.Max.X; x += config.PixelStep {
+			if config.masked(bounds, x, y) {
+				continue
+			}
 
 			// Find the best matching pixel in the right image (along the epipolar line)
 			bestDisparity := 0.0
@@ -79,17 +149,93 @@ func StereoToPointCloud(leftImg, rightImg image.Image, config StereoPCDConfig) (
 
 			// Filter out low confidence disparity values
 			if bestDisparity > config.MinDisparity && bestDisparity < config.MaxDisparity {
-				// Calculate Z (depth) using the formula: Z = (baseline * focal_length) / disparity
-				z := (config.Baseline * config.FocalLength) / bestDisparity
+				err := setPoint(pc, leftImg, x, y, bestDisparity, cx, cy, config)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
 
-				// Calculate X and Y using the pinhole camera model
-				x3d := ((float64(x) - cx) * z) / config.FocalLength
-				y3d := ((float64(y) - cy) * z) / config.FocalLength
+	return pc, nil
+}
+
+// BaselineImage is an image from a camera rectified against the reference camera
+// and offset from it along the x axis by Baseline meters (positive is to the right)
+type BaselineImage struct {
+	Image    image.Image
+	Baseline float64
+}
+
+// MultiBaselineStereoToPointCloud matches the reference image against several images at once.
+// Candidates are sampled in inverse depth, expressed as a disparity at config.Baseline, and the
+// matching costs of all pairs are summed before picking the best one (Okutomi & Kanade).
+// Short baselines keep working up close while long ones add precision at range, and the
+// combined cost resolves the ambiguities a single pair has on repetitive textures.
+func MultiBaselineStereoToPointCloud(refImg image.Image, others []BaselineImage, config StereoPCDConfig) (pointcloud.PointCloud, error) {
+	if len(others) == 0 {
+		return nil, fmt.Errorf("need at least one image to match against")
+	}
+	if config.Baseline <= 0 {
+		return nil, fmt.Errorf("baseline must be positive")
+	}
+
+	bounds := refImg.Bounds()
+	for _, o := range others {
+		otherBounds := o.Image.Bounds()
+		if bounds.Dx() != otherBounds.Dx() || bounds.Dy() != otherBounds.Dy() {
+			return nil, fmt.Errorf("images must have the same dimensions")
+		}
+		if o.Baseline == 0 {
+			return nil, fmt.Errorf("baseline of a matched image cannot be 0")
+		}
+	}
+
+	cx := float64(bounds.Dx()) / 2.0
+	cy := float64(bounds.Dy()) / 2.0
 
-				err := pc.Set(
-					r3.Vector{X: x3d, Y: y3d, Z: z},
-					pointcloud.NewColoredData(color.NRGBA{R: r8, G: g8, B: b8, A: 1}),
-				)
+	matchBounds, err := config.matchBounds(bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := pointcloud.New()
+
+	for y := matchBounds.Min.Y; y < matchBounds.Max.Y; y += config.PixelStep {
+		for x := matchBounds.Min.X; x < matchBounds.Max.X; x += config.PixelStep {
+			if config.masked(bounds, x, y) {
+				continue
+			}
+
+			bestDisparity := 0.0
+			minCost := math.MaxFloat64
+
+			for d := 0; d <= int(config.MaxDisparity); d += config.DisparityStep {
+				cost := 0.0
+				pairs := 0
+				for _, o := range others {
+					// same inverse depth, so disparity scales with the baseline of each pair
+					searchX := x - int(math.Round(float64(d)*o.Baseline/config.Baseline))
+					if searchX < bounds.Min.X || searchX >= bounds.Max.X {
+						continue
+					}
+					cost += calculatePixelDifference(refImg, o.Image, x, y, searchX, y)
+					pairs++
+				}
+				if pairs == 0 {
+					continue
+				}
+
+				// normalize so candidates near the edges, where some pairs drop out, stay comparable
+				cost /= float64(pairs)
+				if cost < minCost {
+					minCost = cost
+					bestDisparity = float64(d)
+				}
+			}
+
+			if bestDisparity > config.MinDisparity && bestDisparity < config.MaxDisparity {
+				err := setPoint(pc, refImg, x, y, bestDisparity, cx, cy, config)
 				if err != nil {
 					return nil, err
 				}
@@ -0,0 +1,119 @@
+package viamstereocamera
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/golang/geo/r3"
+	"go.viam.com/test"
+
+	"go.viam.com/rdk/pointcloud"
+)
+
+// stripes makes an image with a pattern repeating every period pixels, shifted left by shift
+func stripes(w, h, period, shift int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(((x + shift) % period) * 30)
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+// fractionAtDepth returns the fraction of points with x at or beyond minX that are at depth z
+func fractionAtDepth(pc pointcloud.PointCloud, minX, z float64) float64 {
+	total, good := 0, 0
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		if p.X < minX {
+			return true
+		}
+		total++
+		if p.Z > z-.001 && p.Z < z+.001 {
+			good++
+		}
+		return true
+	})
+	if total == 0 {
+		return 0
+	}
+	return float64(good) / float64(total)
+}
+
+func TestMultiBaselineRepetitiveTexture(t *testing.T) {
+	config := StereoPCDConfig{
+		Baseline:      .2,
+		FocalLength:   100,
+		MinDisparity:  1,
+		MaxDisparity:  16,
+		DisparityStep: 1,
+		PixelStep:     1,
+	}
+
+	// true disparity is 12 at the long baseline, and the pattern repeats every 8
+	ref := stripes(64, 4, 8, 0)
+	long := stripes(64, 4, 8, 12)
+	short := stripes(64, 4, 8, 6)
+
+	expectedZ := config.Baseline * config.FocalLength / 12
+	minX := (16 - 32) * expectedZ / config.FocalLength // skip the left edge
+
+	pair, err := StereoToPointCloud(ref, long, config)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, fractionAtDepth(pair, minX, expectedZ), test.ShouldBeLessThan, .1)
+
+	multi, err := MultiBaselineStereoToPointCloud(ref, []BaselineImage{
+		{Image: short, Baseline: .1},
+		{Image: long, Baseline: .2},
+	}, config)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, fractionAtDepth(multi, minX, expectedZ), test.ShouldAlmostEqual, 1)
+}
+
+func TestMaskAndCrop(t *testing.T) {
+	config := StereoPCDConfig{
+		Baseline:      .2,
+		FocalLength:   100,
+		MinDisparity:  1,
+		MaxDisparity:  16,
+		DisparityStep: 1,
+		PixelStep:     1,
+	}
+
+	ref := stripes(64, 8, 64, 0)
+	right := stripes(64, 8, 64, 4)
+
+	// mask out the bottom half, like a bumper in view
+	mask := image.NewGray(image.Rect(0, 0, 64, 8))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 64; x++ {
+			mask.SetGray(x, y, color.Gray{255})
+		}
+	}
+	config.Mask = mask
+
+	pc, err := StereoToPointCloud(ref, right, config)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, pc.Size(), test.ShouldBeGreaterThan, 0)
+	pc.Iterate(0, 0, func(p r3.Vector, d pointcloud.Data) bool {
+		test.That(t, p.Y, test.ShouldBeLessThan, 0)
+		return true
+	})
+
+	config.ROI = image.Rect(32, 0, 64, 8)
+	roi, err := StereoToPointCloud(ref, right, config)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, roi.Size(), test.ShouldEqual, 32*4)
+
+	// true depth is 5m
+	config.CropBox = &Box{Min: r3.Vector{X: -10, Y: -10, Z: 0}, Max: r3.Vector{X: 10, Y: 10, Z: 4}}
+	cropped, err := StereoToPointCloud(ref, right, config)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, cropped.Size(), test.ShouldEqual, 0)
+
+	config.Mask = image.NewGray(image.Rect(0, 0, 32, 8))
+	_, err = StereoToPointCloud(ref, right, config)
+	test.That(t, err, test.ShouldNotBeNil)
+}